@@ -0,0 +1,129 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// AgentInfo returns the node name and the datacenter of the consul agent the service is talking to.
+func AgentInfo() (nodeName, datacenter string, err error) {
+	consul, err := newClient(defaultConfig())
+	if err != nil {
+		return "", "", fmt.Errorf("could not create consul client %w", err)
+	}
+
+	self, err := consul.Agent().Self()
+	if err != nil {
+		return "", "", fmt.Errorf("retrieving agent info failed %w", err)
+	}
+
+	config := self["Config"]
+	nodeName, _ = config["NodeName"].(string)
+	datacenter, _ = config["Datacenter"].(string)
+	return nodeName, datacenter, nil
+}
+
+// UpdateTTL sets the status (passing, warning or critical) and the output of the TTL check with the given ID.
+func UpdateTTL(checkID, status, output string) error {
+	consul, err := newClient(defaultConfig())
+	if err != nil {
+		return fmt.Errorf("could not create consul client %w", err)
+	}
+
+	err = consul.Agent().UpdateTTL(checkID, output, status)
+	if err != nil {
+		return fmt.Errorf("updating ttl check failed %w", err)
+	}
+	return nil
+}
+
+// ListLocalServices returns all services registered at the local consul agent by their ID.
+func ListLocalServices() (map[string]*api.AgentService, error) {
+	consul, err := newClient(defaultConfig())
+	if err != nil {
+		return nil, fmt.Errorf("could not create consul client %w", err)
+	}
+
+	services, err := consul.Agent().Services()
+	if err != nil {
+		return nil, fmt.Errorf("listing local services failed %w", err)
+	}
+	return services, nil
+}
+
+// DeregisterAllForHost removes all services of the local consul agent which belong to the given hostname,
+// i.e. which use it as ID or address. This is useful to clean up services left over by crashed instances.
+func DeregisterAllForHost(hostname string) error {
+	services, err := ListLocalServices()
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	for id, s := range services {
+		if s.ID != hostname && s.Address != hostname {
+			continue
+		}
+		if err := DeregisterConsulService(id); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", id, err))
+		}
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("deregistering services of host %s failed %s", hostname, strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// Leader returns the address of the current leader of the consul cluster.
+// An empty address means the cluster has no leader, e.g. during an election.
+func Leader() (string, error) {
+	consul, err := newClient(defaultConfig())
+	if err != nil {
+		return "", fmt.Errorf("could not create consul client %w", err)
+	}
+
+	leader, err := consul.Status().Leader()
+	if err != nil {
+		return "", fmt.Errorf("retrieving leader failed %w", err)
+	}
+	return leader, nil
+}
+
+// Peers returns the addresses of the raft peers of the consul cluster.
+func Peers() ([]string, error) {
+	consul, err := newClient(defaultConfig())
+	if err != nil {
+		return nil, fmt.Errorf("could not create consul client %w", err)
+	}
+
+	peers, err := consul.Status().Peers()
+	if err != nil {
+		return nil, fmt.Errorf("retrieving peers failed %w", err)
+	}
+	return peers, nil
+}
+
+// DeregisterByName removes all instances of the service with the given name from the local consul agent
+// and returns how many were removed.
+func DeregisterByName(serviceName string) (int, error) {
+	services, err := ListLocalServices()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for id, s := range services {
+		if s.Service != serviceName {
+			continue
+		}
+		if err := DeregisterConsulService(id); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,43 @@
+package common
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	asyncRegisterAttempts  = 8
+	asyncRegisterBaseDelay = time.Second
+)
+
+// RegisterConsulServiceAsync registers the service like RegisterConsulService in the background,
+// so the service can start serving without waiting for consul. Failed registrations are retried with
+// exponential backoff for about two minutes. The callback gets the registration or the last error.
+// Calling the returned function stops the retries; the callback then gets context.Canceled.
+func RegisterConsulServiceAsync(serviceName string, done func(*api.AgentServiceRegistration, error), options ...Option) (stop func()) {
+	cfg := defaultConfig()
+	for _, o := range options {
+		o(cfg)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer cancel()
+
+		var registration *api.AgentServiceRegistration
+		err := retry(ctx, asyncRegisterAttempts, asyncRegisterBaseDelay, func() error {
+			var err error
+			registration, err = register(serviceName, cfg)
+			return err
+		})
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		if done != nil {
+			done(registration, err)
+		}
+	}()
+	return cancel
+}
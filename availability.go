@@ -0,0 +1,90 @@
+package common
+
+import (
+	"errors"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Availability is the overall availability of a service across all its instances.
+type Availability int
+
+const (
+	// AvailabilityNotRegistered means there is no instance of the service at all.
+	AvailabilityNotRegistered Availability = iota
+	// AvailabilityDown means no instance is passing or warning.
+	AvailabilityDown
+	// AvailabilityDegraded means no instance is passing but at least one is warning.
+	AvailabilityDegraded
+	// AvailabilityUp means at least one instance is passing.
+	AvailabilityUp
+)
+
+func (a Availability) String() string {
+	switch a {
+	case AvailabilityDown:
+		return "down"
+	case AvailabilityDegraded:
+		return "degraded"
+	case AvailabilityUp:
+		return "up"
+	default:
+		return "not registered"
+	}
+}
+
+// ServiceAvailability returns the overall availability of the service with the given name.
+func ServiceAvailability(serviceName string) (Availability, error) {
+	services, err := queryInstances(serviceName, false, &api.QueryOptions{})
+	if err != nil {
+		return AvailabilityNotRegistered, err
+	}
+	if len(services) == 0 {
+		return AvailabilityNotRegistered, nil
+	}
+
+	availability := AvailabilityDown
+	for _, s := range services {
+		switch s.Checks.AggregatedStatus() {
+		case api.HealthPassing:
+			return AvailabilityUp, nil
+		case api.HealthWarning:
+			availability = AvailabilityDegraded
+		}
+	}
+	return availability, nil
+}
+
+// HealthStatus is the aggregated status of the checks of an instance.
+type HealthStatus string
+
+const (
+	HealthStatusPassing     HealthStatus = api.HealthPassing
+	HealthStatusWarning     HealthStatus = api.HealthWarning
+	HealthStatusCritical    HealthStatus = api.HealthCritical
+	HealthStatusMaintenance HealthStatus = api.HealthMaint
+)
+
+// ErrInstanceNotFound is returned if no instance with the given ID is registered for the service.
+var ErrInstanceNotFound = errors.New("instance not found")
+
+// InstanceHealth returns the aggregated status and the single checks of the instance of the service
+// with the given ID, e.g. to find out why it is critical.
+func InstanceHealth(serviceName, instanceID string) (HealthStatus, []api.HealthCheck, error) {
+	services, err := queryInstances(serviceName, false, &api.QueryOptions{})
+	if err != nil {
+		return "", nil, err
+	}
+
+	for _, s := range services {
+		if s.Service.ID != instanceID {
+			continue
+		}
+		checks := make([]api.HealthCheck, 0, len(s.Checks))
+		for _, c := range s.Checks {
+			checks = append(checks, *c)
+		}
+		return HealthStatus(s.Checks.AggregatedStatus()), checks, nil
+	}
+	return "", nil, ErrInstanceNotFound
+}
@@ -0,0 +1,65 @@
+package common
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	backgroundMu sync.Mutex
+	// background holds the cancel functions of the running background tasks per service ID.
+	background = make(map[string][]context.CancelFunc)
+)
+
+// startBackground runs the task in the background until the service with the given ID gets deregistered.
+func startBackground(serviceID string, task func(ctx context.Context)) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	backgroundMu.Lock()
+	background[serviceID] = append(background[serviceID], cancel)
+	backgroundMu.Unlock()
+
+	atomic.AddInt64(&activeBackgroundTasks, 1)
+	go func() {
+		defer atomic.AddInt64(&activeBackgroundTasks, -1)
+		task(ctx)
+	}()
+}
+
+var (
+	activeWatches         int64
+	activeHeartbeats      int64
+	activeBackgroundTasks int64
+)
+
+// ActiveWatches returns the number of running watches, including the refresh of caches (see NewServiceCache)
+// and notifications. It drops to zero once all watches are stopped and caches are closed, e.g. to detect leaked goroutines.
+func ActiveWatches() int {
+	return int(atomic.LoadInt64(&activeWatches))
+}
+
+// ActiveHeartbeats returns the number of running updates of TTL checks.
+// They stop shortly after the deregistration of their service or the cancellation of their context.
+func ActiveHeartbeats() int {
+	return int(atomic.LoadInt64(&activeHeartbeats))
+}
+
+// ActiveBackgroundTasks returns the number of running background tasks of registrations, e.g. heartbeats,
+// periodic resyncs, dynamic weights and the signal handlers of WithDrainOnSignal and WithAutoDeregisterOnShutdown.
+// They stop shortly after the deregistration of their service.
+func ActiveBackgroundTasks() int {
+	return int(atomic.LoadInt64(&activeBackgroundTasks))
+}
+
+// stopBackground stops all background tasks of the service with the given ID.
+func stopBackground(serviceID string) {
+	backgroundMu.Lock()
+	cancels := background[serviceID]
+	delete(background, serviceID)
+	backgroundMu.Unlock()
+
+	for _, cancel := range cancels {
+		cancel()
+	}
+}
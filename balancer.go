@@ -0,0 +1,119 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Balancer selects the instance of a service to use for the next call.
+// The balancers of this package keep the instances up-to-date by a watch per service,
+// so Next doesn't query consul (see StopSharedWatches).
+type Balancer interface {
+	Next() (*api.ServiceEntry, error)
+}
+
+// NewRoundRobinBalancer returns a balancer which rotates over the healthy instances of the service.
+func NewRoundRobinBalancer(serviceName string) Balancer {
+	return &roundRobinBalancer{serviceName: serviceName}
+}
+
+type roundRobinBalancer struct {
+	serviceName string
+
+	mu   sync.Mutex
+	next int
+}
+
+func (b *roundRobinBalancer) Next() (*api.ServiceEntry, error) {
+	services, err := sortedServices(b.serviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := services[b.next%len(services)]
+	b.next++
+	return s, nil
+}
+
+// NewWeightedRoundRobinBalancer returns a balancer which rotates over the healthy instances of the service
+// preferring them according to their passing weight, using the smooth weighted round robin algorithm of nginx.
+// E.g. for instances a, b, c with the weights 5, 1, 1 the rotation is a, a, b, a, c, a, a.
+func NewWeightedRoundRobinBalancer(serviceName string) Balancer {
+	return &weightedRoundRobinBalancer{serviceName: serviceName}
+}
+
+type weightedRoundRobinBalancer struct {
+	serviceName string
+
+	mu        sync.Mutex
+	instances string
+	current   map[string]int
+}
+
+func (b *weightedRoundRobinBalancer) Next() (*api.ServiceEntry, error) {
+	services, err := sortedServices(b.serviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.pick(services), nil
+}
+
+// pick selects the next of the services, which have to be sorted by ID.
+func (b *weightedRoundRobinBalancer) pick(services []*api.ServiceEntry) *api.ServiceEntry {
+	// restart the schedule whenever the instances or their weights change
+	if instances := instanceSet(services); instances != b.instances {
+		b.instances = instances
+		b.current = make(map[string]int, len(services))
+	}
+
+	var best *api.ServiceEntry
+	total := 0
+	for _, s := range services {
+		w := passingWeight(s)
+		b.current[s.Service.ID] += w
+		total += w
+		if best == nil || b.current[s.Service.ID] > b.current[best.Service.ID] {
+			best = s
+		}
+	}
+	b.current[best.Service.ID] -= total
+	return best
+}
+
+// sortedServices returns the watched healthy instances of the service sorted by ID.
+// The returned slice is shared and must not be modified.
+func sortedServices(serviceName string) ([]*api.ServiceEntry, error) {
+	services, err := sharedServices(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	if len(services) == 0 {
+		return nil, fmt.Errorf("no healthy instance of service %s found", serviceName)
+	}
+	return services, nil
+}
+
+// instanceSet returns a key identifying the instances and their weights.
+func instanceSet(services []*api.ServiceEntry) string {
+	keys := make([]string, 0, len(services))
+	for _, s := range services {
+		keys = append(keys, fmt.Sprintf("%s=%d", s.Service.ID, passingWeight(s)))
+	}
+	return strings.Join(keys, ",")
+}
+
+// passingWeight returns the passing weight of the instance which is at least 1.
+func passingWeight(entry *api.ServiceEntry) int {
+	if entry.Service.Weights.Passing < 1 {
+		return 1
+	}
+	return entry.Service.Weights.Passing
+}
@@ -0,0 +1,65 @@
+package common
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func entryWithWeight(id string, weight int) *api.ServiceEntry {
+	return &api.ServiceEntry{Service: &api.AgentService{ID: id, Weights: api.AgentWeights{Passing: weight, Warning: 1}}}
+}
+
+func TestWeightedRoundRobinBalancerPick(t *testing.T) {
+	tests := []struct {
+		name     string
+		services []*api.ServiceEntry
+		rounds   int
+		want     string
+	}{
+		{
+			name:     "smooth weights",
+			services: []*api.ServiceEntry{entryWithWeight("a", 5), entryWithWeight("b", 1), entryWithWeight("c", 1)},
+			rounds:   14,
+			want:     "a,a,b,a,c,a,a,a,a,b,a,c,a,a",
+		},
+		{
+			name:     "equal weights",
+			services: []*api.ServiceEntry{entryWithWeight("a", 1), entryWithWeight("b", 1), entryWithWeight("c", 1)},
+			rounds:   6,
+			want:     "a,b,c,a,b,c",
+		},
+		{
+			name:     "missing weights count as 1",
+			services: []*api.ServiceEntry{entryWithWeight("a", 0), entryWithWeight("b", 2)},
+			rounds:   6,
+			want:     "b,a,b,b,a,b",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &weightedRoundRobinBalancer{}
+			picked := make([]string, 0, tt.rounds)
+			for i := 0; i < tt.rounds; i++ {
+				picked = append(picked, b.pick(tt.services).Service.ID)
+			}
+			if got := strings.Join(picked, ","); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestWeightedRoundRobinBalancerPickRestartsOnChange(t *testing.T) {
+	b := &weightedRoundRobinBalancer{}
+	b.pick([]*api.ServiceEntry{entryWithWeight("a", 5), entryWithWeight("b", 1)})
+
+	services := []*api.ServiceEntry{entryWithWeight("a", 1), entryWithWeight("b", 1)}
+	if got := b.pick(services).Service.ID; got != "a" {
+		t.Errorf("expected the schedule to restart with a, got %s", got)
+	}
+	if got := b.pick(services).Service.ID; got != "b" {
+		t.Errorf("expected b, got %s", got)
+	}
+}
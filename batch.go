@@ -0,0 +1,111 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// ServiceDefinition is a service registered by RegisterConsulServices with its own options.
+type ServiceDefinition struct {
+	Name    string
+	Options []Option
+}
+
+// BatchError is returned by RegisterConsulServices if any service failed to register.
+type BatchError struct {
+	// Registered holds the IDs of the services which are registered, including those whose rollback failed.
+	Registered []string
+	// RolledBack holds the IDs of the services which were registered but got deregistered again.
+	RolledBack []string
+	// Failed holds the errors by the name of the failed services.
+	Failed map[string]error
+}
+
+func (e *BatchError) Error() string {
+	names := make([]string, 0, len(e.Failed))
+	for name := range e.Failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	failures := make([]string, 0, len(names))
+	for _, name := range names {
+		failures = append(failures, fmt.Sprintf("%s: %v", name, e.Failed[name]))
+	}
+	return fmt.Sprintf("registering services failed %s", strings.Join(failures, ", "))
+}
+
+// WithBatchRollback makes RegisterConsulServices all-or-nothing: if any service fails,
+// the already registered ones get deregistered again.
+func WithBatchRollback() Option {
+	return func(o *config) {
+		o.batchRollback = true
+	}
+}
+
+// RegisterConsulServices registers all services and returns their registrations.
+// The options apply to all services, before the options of the single services.
+// The ID of each service defaults to "<hostname>-<service name>", so the services don't replace each other.
+//
+// By default, the registration is best-effort: all services are tried and the error is a *BatchError
+// listing the registered and the failed services. With WithBatchRollback it stops at the first failure
+// and deregisters the services registered so far.
+func RegisterConsulServices(services []ServiceDefinition, options ...Option) ([]*api.AgentServiceRegistration, error) {
+	batchCfg := defaultConfig()
+	for _, o := range options {
+		o(batchCfg)
+	}
+
+	var registrations []*api.AgentServiceRegistration
+	var configs []*config
+	batchErr := &BatchError{Failed: make(map[string]error)}
+
+	for _, s := range services {
+		cfg := defaultConfig()
+		name := s.Name
+		withRegistrationStep(func(registration *api.AgentServiceRegistration) error {
+			registration.ID = fmt.Sprintf("%s-%s", Hostname(), name)
+			return nil
+		})(cfg)
+		for _, o := range options {
+			o(cfg)
+		}
+		for _, o := range s.Options {
+			o(cfg)
+		}
+
+		registration, err := register(s.Name, cfg)
+		if err != nil {
+			batchErr.Failed[s.Name] = err
+			if batchCfg.batchRollback {
+				break
+			}
+			continue
+		}
+		registrations = append(registrations, registration)
+		configs = append(configs, cfg)
+	}
+
+	if len(batchErr.Failed) == 0 {
+		return registrations, nil
+	}
+	if !batchCfg.batchRollback {
+		for _, registration := range registrations {
+			batchErr.Registered = append(batchErr.Registered, registration.ID)
+		}
+		return registrations, batchErr
+	}
+
+	for i, registration := range registrations {
+		if err := deregister(registration.ID, configs[i]); err != nil {
+			batchErr.Registered = append(batchErr.Registered, registration.ID)
+			batchErr.Failed[registration.Name] = fmt.Errorf("rolling back failed %w", err)
+			continue
+		}
+		batchErr.RolledBack = append(batchErr.RolledBack, registration.ID)
+	}
+	return nil, batchErr
+}
@@ -0,0 +1,92 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// metaKeyPattern are the meta data keys consul accepts.
+var metaKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// BuildRegistration builds and validates the registration like RegisterConsulService without contacting consul,
+// e.g. to verify the composition of the options in tests or CI.
+// Side effects like starting the health webserver and the checks against consul, e.g. of WithConflictDetection, are skipped.
+func BuildRegistration(serviceName string, options ...Option) (*api.AgentServiceRegistration, error) {
+	cfg := defaultConfig()
+	for _, o := range options {
+		o(cfg)
+	}
+	if cfg.optionErr != nil {
+		return nil, cfg.optionErr
+	}
+
+	return buildRegistration(serviceName, cfg)
+}
+
+// validateRegistration checks the registration against the limits of consul.
+func validateRegistration(registration *api.AgentServiceRegistration) error {
+	if strings.TrimSpace(registration.Name) == "" {
+		return errors.New("the service name must not be empty")
+	}
+	if registration.Port < 0 || registration.Port > 65535 {
+		return fmt.Errorf("invalid port %d", registration.Port)
+	}
+
+	if len(registration.Meta) > 64 {
+		return fmt.Errorf("too many meta data keys %d, at most 64 are allowed", len(registration.Meta))
+	}
+	for key, value := range registration.Meta {
+		if !metaKeyPattern.MatchString(key) || len(key) > 128 || strings.HasPrefix(key, "consul-") {
+			return fmt.Errorf("invalid meta data key %q", key)
+		}
+		if len(value) > 512 {
+			return fmt.Errorf("the meta data value of %s is longer than 512 characters", key)
+		}
+	}
+
+	for _, check := range checks(registration) {
+		for _, d := range []string{check.Interval, check.Timeout, check.TTL, check.DeregisterCriticalServiceAfter} {
+			if _, err := parseCheckDuration(d); err != nil {
+				return fmt.Errorf("invalid check duration %w", err)
+			}
+		}
+		if check.TTL != "" && check.Interval != "" {
+			return errors.New("checks can't have both a TTL and an interval")
+		}
+		if (check.HTTP != "" || check.TCP != "" || check.GRPC != "" || check.H2PING != "" || len(check.Args) > 0) && check.Interval == "" {
+			return errors.New("checks need an interval")
+		}
+		// socket registrations have no address and port the checks could fall back to
+		if target := checkTarget(check); registration.SocketPath != "" && target != "" {
+			if host, port, err := net.SplitHostPort(target); err != nil || host == "" || port == "" || port == "0" {
+				return fmt.Errorf("checks of a service with a socket path need an explicit host and port, got %q", target)
+			}
+		}
+	}
+	return nil
+}
+
+// checkTarget returns the host and port the check connects to, empty for checks without one.
+func checkTarget(check *api.AgentServiceCheck) string {
+	switch {
+	case check.HTTP != "":
+		u, err := url.Parse(check.HTTP)
+		if err != nil {
+			return check.HTTP
+		}
+		return u.Host
+	case check.TCP != "":
+		return check.TCP
+	case check.GRPC != "":
+		return strings.SplitN(check.GRPC, "/", 2)[0]
+	case check.H2PING != "":
+		return check.H2PING
+	}
+	return ""
+}
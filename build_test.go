@@ -0,0 +1,161 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestValidateRegistration(t *testing.T) {
+	tooManyMeta := make(map[string]string)
+	for i := 0; i < 65; i++ {
+		tooManyMeta[fmt.Sprintf("key%d", i)] = "value"
+	}
+
+	tests := []struct {
+		name         string
+		registration api.AgentServiceRegistration
+		wantErr      string
+	}{
+		{
+			name:         "valid",
+			registration: api.AgentServiceRegistration{Name: "orders", Port: 8100, Meta: map[string]string{"version": "1.0.0", "build_id": "a-1"}},
+		},
+		{
+			name:         "empty name",
+			registration: api.AgentServiceRegistration{Name: " "},
+			wantErr:      "the service name must not be empty",
+		},
+		{
+			name:         "negative port",
+			registration: api.AgentServiceRegistration{Name: "orders", Port: -1},
+			wantErr:      "invalid port -1",
+		},
+		{
+			name:         "port too large",
+			registration: api.AgentServiceRegistration{Name: "orders", Port: 65536},
+			wantErr:      "invalid port 65536",
+		},
+		{
+			name:         "too many meta keys",
+			registration: api.AgentServiceRegistration{Name: "orders", Meta: tooManyMeta},
+			wantErr:      "too many meta data keys 65",
+		},
+		{
+			name:         "invalid meta key",
+			registration: api.AgentServiceRegistration{Name: "orders", Meta: map[string]string{"build.id": "1"}},
+			wantErr:      `invalid meta data key "build.id"`,
+		},
+		{
+			name:         "reserved meta key",
+			registration: api.AgentServiceRegistration{Name: "orders", Meta: map[string]string{"consul-version": "1"}},
+			wantErr:      `invalid meta data key "consul-version"`,
+		},
+		{
+			name:         "meta key too long",
+			registration: api.AgentServiceRegistration{Name: "orders", Meta: map[string]string{strings.Repeat("k", 129): "1"}},
+			wantErr:      "invalid meta data key",
+		},
+		{
+			name:         "meta value too long",
+			registration: api.AgentServiceRegistration{Name: "orders", Meta: map[string]string{"notes": strings.Repeat("v", 513)}},
+			wantErr:      "the meta data value of notes is longer than 512 characters",
+		},
+		{
+			name: "invalid check duration",
+			registration: api.AgentServiceRegistration{Name: "orders", Check: &api.AgentServiceCheck{
+				TCP: "orders:8100", Interval: "5 seconds",
+			}},
+			wantErr: "invalid check duration",
+		},
+		{
+			name: "check without interval",
+			registration: api.AgentServiceRegistration{Name: "orders", Checks: api.AgentServiceChecks{
+				{TTL: "10s"},
+				{HTTP: "http://orders:8101/healthcheck"},
+			}},
+			wantErr: "checks need an interval",
+		},
+		{
+			name:         "ttl check with interval",
+			registration: api.AgentServiceRegistration{Name: "orders", Check: &api.AgentServiceCheck{TTL: "10s", Interval: "5s"}},
+			wantErr:      "checks can't have both a TTL and an interval",
+		},
+		{
+			name:         "ttl check without interval",
+			registration: api.AgentServiceRegistration{Name: "orders", Check: &api.AgentServiceCheck{TTL: "10s"}},
+		},
+		{
+			name:         "socket path with a check without host",
+			registration: api.AgentServiceRegistration{Name: "orders", SocketPath: "/run/orders.sock", Check: &api.AgentServiceCheck{TCP: ":0", Interval: "5s"}},
+			wantErr:      `checks of a service with a socket path need an explicit host and port, got ":0"`,
+		},
+		{
+			name:         "socket path with a grpc check without port",
+			registration: api.AgentServiceRegistration{Name: "orders", SocketPath: "/run/orders.sock", Check: &api.AgentServiceCheck{GRPC: "localhost:0/orders", Interval: "5s"}},
+			wantErr:      `need an explicit host and port, got "localhost:0"`,
+		},
+		{
+			name:         "socket path with an explicit check target",
+			registration: api.AgentServiceRegistration{Name: "orders", SocketPath: "/run/orders.sock", Check: &api.AgentServiceCheck{H2PING: "localhost:8443", Interval: "5s"}},
+		},
+		{
+			name:         "socket path with a ttl check",
+			registration: api.AgentServiceRegistration{Name: "orders", SocketPath: "/run/orders.sock", Check: &api.AgentServiceCheck{TTL: "10s"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateRegistration(&tt.registration)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected an error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestBuildRegistrationSocketPathChecks(t *testing.T) {
+	if _, err := BuildRegistration("orders", WithSocketPath("/run/orders.sock"), WithTCPHealthCheck(0)); err == nil {
+		t.Error("expected an error for a tcp check without a target")
+	}
+
+	registration, err := BuildRegistration("orders", WithSocketPath("/run/orders.sock"),
+		WithTCPHealthCheck(0, HealthCheckConfig{Host: "localhost", Port: 9000}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if registration.Check == nil || registration.Check.TCP != "localhost:9000" {
+		t.Errorf("expected the tcp check of localhost:9000, got %+v", registration.Check)
+	}
+}
+
+func TestBuildRegistrationTTLCheckSkipsInterval(t *testing.T) {
+	registration, err := BuildRegistration("orders",
+		WithHealthCheckConfig(HealthCheckConfig{Interval: 10 * time.Second, Timeout: 2 * time.Second}),
+		WithTTLHealthCheck(30*time.Second),
+		WithTCPHealthCheck(8100),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, check := range checks(registration) {
+		switch {
+		case check.TTL != "":
+			if check.Interval != "" || check.Timeout != "" {
+				t.Errorf("expected the ttl check without interval and timeout, got %q and %q", check.Interval, check.Timeout)
+			}
+		case check.Interval != "10s" || check.Timeout != "2s":
+			t.Errorf("expected the tcp check with the interval 10s and the timeout 2s, got %q and %q", check.Interval, check.Timeout)
+		}
+	}
+}
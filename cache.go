@@ -0,0 +1,120 @@
+package common
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// ServiceCache caches the healthy instances of services and refreshes them periodically in the background.
+// Services are added to the cache by their first Get.
+type ServiceCache struct {
+	mu      sync.Mutex
+	entries map[string][]*api.ServiceEntry
+	// generations changes with each invalidation, so refreshes started before don't store stale results
+	generations map[string]uint64
+	services    map[string]bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewServiceCache creates a cache which refreshes its services with the given interval.
+// The cache has to be closed to stop the background refresh.
+func NewServiceCache(refreshInterval time.Duration) *ServiceCache {
+	c := &ServiceCache{
+		entries:     make(map[string][]*api.ServiceEntry),
+		generations: make(map[string]uint64),
+		services:    make(map[string]bool),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	atomic.AddInt64(&activeWatches, 1)
+	go c.refreshLoop(refreshInterval)
+	return c
+}
+
+// Get returns the cached healthy instances of the service and queries consul if they are not cached (anymore).
+func (c *ServiceCache) Get(serviceName string) ([]*api.ServiceEntry, error) {
+	c.mu.Lock()
+	services, ok := c.entries[serviceName]
+	c.services[serviceName] = true
+	c.mu.Unlock()
+	if ok {
+		return services, nil
+	}
+
+	return c.refresh(serviceName)
+}
+
+// Invalidate removes the service from the cache, so the next Get queries consul.
+func (c *ServiceCache) Invalidate(serviceName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, serviceName)
+	c.generations[serviceName]++
+}
+
+// InvalidateAll removes all services from the cache, so the next Get of each service queries consul.
+func (c *ServiceCache) InvalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for serviceName := range c.services {
+		delete(c.entries, serviceName)
+		c.generations[serviceName]++
+	}
+}
+
+// Close stops the background refresh.
+func (c *ServiceCache) Close() {
+	close(c.stop)
+	<-c.done
+}
+
+// refresh queries the service and stores it unless it got invalidated in the meantime.
+func (c *ServiceCache) refresh(serviceName string) ([]*api.ServiceEntry, error) {
+	c.mu.Lock()
+	generation := c.generations[serviceName]
+	c.mu.Unlock()
+
+	services, err := queryServices(serviceName, &api.QueryOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generations[serviceName] == generation {
+		c.entries[serviceName] = services
+	}
+	return services, nil
+}
+
+func (c *ServiceCache) refreshLoop(interval time.Duration) {
+	defer close(c.done)
+	defer atomic.AddInt64(&activeWatches, -1)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+
+		c.mu.Lock()
+		serviceNames := make([]string, 0, len(c.services))
+		for serviceName := range c.services {
+			serviceNames = append(serviceNames, serviceName)
+		}
+		c.mu.Unlock()
+
+		for _, serviceName := range serviceNames {
+			// failed refreshes keep the last known instances
+			_, _ = c.refresh(serviceName)
+		}
+	}
+}
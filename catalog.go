@@ -0,0 +1,191 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// WithCatalogRegistration registers the service using the catalog api of the consul servers
+// instead of the local consul agent. This allows registering services in environments without agents.
+//
+// Be aware that without an agent there is no anti-entropy: nobody keeps the catalog in sync with the
+// service and nobody runs its checks. The checks are registered with their definitions and an initial
+// passing status, so that an external monitor like consul-esm can execute them. The node is marked as
+// external node for that reason. Only HTTP and TCP checks can be expressed this way, registrations with
+// other checks, e.g. TTL, gRPC, H2PING or script checks, fail as nobody could ever update them.
+func WithCatalogRegistration() Option {
+	return func(o *config) {
+		o.catalogRegistration = true
+	}
+}
+
+// WithCatalogFallback registers the service using the catalog api (see WithCatalogRegistration)
+// if no local consul agent is reachable. The deregistration uses the same path as the registration.
+// The catalog registration is sent to the configured address as well, so the fallback only helps with an address
+// which reaches the consul servers.
+func WithCatalogFallback() Option {
+	return func(o *config) {
+		o.catalogFallback = true
+	}
+}
+
+var (
+	catalogFallbacksMu sync.Mutex
+	// catalogFallbacks holds the IDs of the services which fell back to the catalog registration.
+	catalogFallbacks = make(map[string]bool)
+)
+
+func setCatalogRegistered(serviceID string, registered bool) {
+	catalogFallbacksMu.Lock()
+	defer catalogFallbacksMu.Unlock()
+	if registered {
+		catalogFallbacks[serviceID] = true
+		return
+	}
+	delete(catalogFallbacks, serviceID)
+}
+
+func catalogRegistered(serviceID string) bool {
+	catalogFallbacksMu.Lock()
+	defer catalogFallbacksMu.Unlock()
+	return catalogFallbacks[serviceID]
+}
+
+// isUnreachable reports whether the error is caused by a failed connection.
+func isUnreachable(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// WithNodeName registers the service for the node with the given name instead of the hostname,
+// e.g. to group related services under a logical node.
+// It only applies to the catalog registration (see WithCatalogRegistration), the agent registers its own node.
+func WithNodeName(name string) Option {
+	return func(o *config) {
+		o.nodeName = name
+	}
+}
+
+// WithNodeAddress sets the address of the node instead of the address of the service.
+// It only applies to the catalog registration (see WithCatalogRegistration), the agent registers its own node.
+func WithNodeAddress(addr string) Option {
+	return func(o *config) {
+		o.nodeAddress = addr
+	}
+}
+
+// node returns the node name used for the catalog registration.
+func (c *config) node() string {
+	if c.nodeName != "" {
+		return c.nodeName
+	}
+	return Hostname()
+}
+
+// catalogRegistration converts the agent registration into a catalog registration.
+func catalogRegistration(registration *api.AgentServiceRegistration, cfg *config) (*api.CatalogRegistration, error) {
+	address := cfg.nodeAddress
+	if address == "" {
+		address = registration.Address
+	}
+	catalog := &api.CatalogRegistration{
+		Node:    cfg.node(),
+		Address: address,
+		NodeMeta: map[string]string{
+			"external-node":  "true",
+			"external-probe": "true",
+		},
+		Service: &api.AgentService{
+			Kind:              registration.Kind,
+			ID:                registration.ID,
+			Service:           registration.Name,
+			Tags:              registration.Tags,
+			Meta:              registration.Meta,
+			Port:              registration.Port,
+			Address:           registration.Address,
+			SocketPath:        registration.SocketPath,
+			TaggedAddresses:   registration.TaggedAddresses,
+			EnableTagOverride: registration.EnableTagOverride,
+			Proxy:             registration.Proxy,
+			Connect:           registration.Connect,
+			Namespace:         registration.Namespace,
+			Partition:         registration.Partition,
+		},
+	}
+	if registration.Weights != nil {
+		catalog.Service.Weights = *registration.Weights
+	}
+
+	for i, c := range checks(registration) {
+		check, err := catalogCheck(catalog.Node, registration, c, i)
+		if err != nil {
+			return nil, err
+		}
+		catalog.Checks = append(catalog.Checks, check)
+	}
+
+	return catalog, nil
+}
+
+// catalogCheck converts the agent check into a catalog health check.
+func catalogCheck(node string, registration *api.AgentServiceRegistration, c *api.AgentServiceCheck, i int) (*api.HealthCheck, error) {
+	if c.HTTP == "" && c.TCP == "" {
+		return nil, errors.New("only HTTP and TCP checks can be registered in the catalog")
+	}
+	interval, err := parseCheckDuration(c.Interval)
+	if err != nil {
+		return nil, fmt.Errorf("invalid check interval %w", err)
+	}
+	timeout, err := parseCheckDuration(c.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid check timeout %w", err)
+	}
+	deregisterAfter, err := parseCheckDuration(c.DeregisterCriticalServiceAfter)
+	if err != nil {
+		return nil, fmt.Errorf("invalid check deregister critical service after %w", err)
+	}
+
+	check := &api.HealthCheck{
+		Node:        node,
+		CheckID:     c.CheckID,
+		Name:        c.Name,
+		Status:      c.Status,
+		Notes:       c.Notes,
+		ServiceID:   registration.ID,
+		ServiceName: registration.Name,
+		Definition: api.HealthCheckDefinition{
+			HTTP:                                   c.HTTP,
+			Header:                                 c.Header,
+			Method:                                 c.Method,
+			Body:                                   c.Body,
+			TLSServerName:                          c.TLSServerName,
+			TLSSkipVerify:                          c.TLSSkipVerify,
+			TCP:                                    c.TCP,
+			IntervalDuration:                       interval,
+			TimeoutDuration:                        timeout,
+			DeregisterCriticalServiceAfterDuration: deregisterAfter,
+		},
+	}
+	if check.CheckID == "" {
+		check.CheckID = fmt.Sprintf("service:%s:%d", registration.ID, i+1)
+	}
+	if check.Name == "" {
+		check.Name = fmt.Sprintf("Service '%s' check", registration.Name)
+	}
+	if check.Status == "" {
+		check.Status = api.HealthPassing
+	}
+	return check, nil
+}
+
+func parseCheckDuration(d string) (time.Duration, error) {
+	if d == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(d)
+}
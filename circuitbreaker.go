@@ -0,0 +1,111 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// ErrCircuitOpen is returned while the circuit of the service is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitBreaker stops discovering services which failed too often in a row.
+// The circuit of a service opens after the threshold of consecutive failures reported with RecordFailure.
+// After the cooldown it is half-open and lets a single call through: its success closes the circuit,
+// its failure opens it again. A trial call which is not reported expires after another cooldown,
+// so the next call is let through.
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+type circuit struct {
+	failures int
+	openedAt time.Time
+	// trialAt is set while the single call of the half-open circuit is running
+	trialAt time.Time
+}
+
+// NewCircuitBreaker returns a circuit breaker opening after threshold consecutive failures
+// and half-opening after the cooldown.
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		circuits:  make(map[string]*circuit),
+	}
+}
+
+// Allow reports whether a call to the service is allowed.
+func (cb *CircuitBreaker) Allow(serviceName string) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	c := cb.circuits[serviceName]
+	if c == nil || c.failures < cb.threshold {
+		return true
+	}
+	if time.Since(c.openedAt) < cb.cooldown {
+		return false
+	}
+	if !c.trialAt.IsZero() && time.Since(c.trialAt) < cb.cooldown {
+		return false
+	}
+	c.trialAt = time.Now()
+	return true
+}
+
+// RecordSuccess closes the circuit of the service.
+func (cb *CircuitBreaker) RecordSuccess(serviceName string) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	delete(cb.circuits, serviceName)
+}
+
+// RecordFailure counts a failed call to the service and opens its circuit if the threshold is reached.
+func (cb *CircuitBreaker) RecordFailure(serviceName string) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	c := cb.circuits[serviceName]
+	if c == nil {
+		c = &circuit{}
+		cb.circuits[serviceName] = c
+	}
+	c.failures++
+	c.trialAt = time.Time{}
+	if c.failures >= cb.threshold {
+		c.openedAt = time.Now()
+	}
+}
+
+// GetRandomService returns any active service with the given name like GetRandomServiceWithConsul
+// but fails with ErrCircuitOpen without querying consul while the circuit of the service is open.
+// The result of the call to the returned instance has to be reported using RecordSuccess or RecordFailure.
+func (cb *CircuitBreaker) GetRandomService(serviceName string) (*api.ServiceEntry, error) {
+	if !cb.Allow(serviceName) {
+		return nil, ErrCircuitOpen
+	}
+
+	services, err := queryServices(serviceName, nil)
+	if err != nil {
+		cb.RecordFailure(serviceName)
+		return nil, err
+	}
+	if len(services) == 0 {
+		cb.RecordFailure(serviceName)
+		return nil, fmt.Errorf("no healthy instance of service %s found", serviceName)
+	}
+
+	return services[rand.Intn(len(services))], nil
+}
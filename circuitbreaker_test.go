@@ -0,0 +1,70 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	cb := NewCircuitBreaker(2, time.Hour)
+	// elapse moves the times of the circuit into the past as if the duration passed
+	elapse := func(d time.Duration) {
+		c := cb.circuits["orders"]
+		c.openedAt = c.openedAt.Add(-d)
+		if !c.trialAt.IsZero() {
+			c.trialAt = c.trialAt.Add(-d)
+		}
+	}
+
+	if !cb.Allow("orders") {
+		t.Fatal("expected a new circuit to be closed")
+	}
+	cb.RecordFailure("orders")
+	if !cb.Allow("orders") {
+		t.Fatal("expected the circuit to stay closed below the threshold")
+	}
+	cb.RecordFailure("orders")
+	if cb.Allow("orders") {
+		t.Fatal("expected the circuit to open at the threshold")
+	}
+	if !cb.Allow("payments") {
+		t.Fatal("expected the circuits of other services to stay closed")
+	}
+
+	elapse(time.Hour)
+	if !cb.Allow("orders") {
+		t.Fatal("expected the half-open circuit to allow a trial")
+	}
+	if cb.Allow("orders") {
+		t.Fatal("expected the half-open circuit to allow a single trial")
+	}
+	cb.RecordFailure("orders")
+	if cb.Allow("orders") {
+		t.Fatal("expected a failed trial to open the circuit again")
+	}
+
+	elapse(time.Hour)
+	if !cb.Allow("orders") {
+		t.Fatal("expected the half-open circuit to allow a trial")
+	}
+	elapse(time.Hour)
+	if !cb.Allow("orders") {
+		t.Fatal("expected an unreported trial to expire after the cooldown")
+	}
+	cb.RecordSuccess("orders")
+	if !cb.Allow("orders") || !cb.Allow("orders") {
+		t.Fatal("expected a successful trial to close the circuit")
+	}
+	cb.RecordFailure("orders")
+	if !cb.Allow("orders") {
+		t.Fatal("expected the failures to be reset by the success")
+	}
+}
+
+func TestNewCircuitBreakerMinThreshold(t *testing.T) {
+	cb := NewCircuitBreaker(0, time.Hour)
+	cb.RecordFailure("orders")
+	if cb.Allow("orders") {
+		t.Fatal("expected the circuit to open after a single failure")
+	}
+}
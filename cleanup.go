@@ -0,0 +1,67 @@
+package common
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// WithCleanupPreviousRegistrations deregisters previous registrations of the same service at the local agent
+// before registering, e.g. those left behind by a container which got recreated with a new hostname.
+//
+// To avoid removing live peers, only registrations with a different ID whose checks are all critical
+// get removed, registrations without checks are kept. If match is not nil, it has to return true as well,
+// e.g. to only remove the registrations of the same logical slot.
+func WithCleanupPreviousRegistrations(match func(*api.AgentService) bool) Option {
+	return func(o *config) {
+		withBeforeRegister(func(registration *api.AgentServiceRegistration) error {
+			return cleanupPreviousRegistrations(registration, match, o)
+		})(o)
+	}
+}
+
+// cleanupPreviousRegistrations deregisters the stale registrations of the service at the local agent.
+func cleanupPreviousRegistrations(registration *api.AgentServiceRegistration, match func(*api.AgentService) bool, cfg *config) error {
+	consul, err := newClient(cfg)
+	if err != nil {
+		return fmt.Errorf("could not create consul client %w", err)
+	}
+
+	services, err := consul.Agent().Services()
+	if err != nil {
+		return fmt.Errorf("listing services failed %w", err)
+	}
+	checks, err := consul.Agent().Checks()
+	if err != nil {
+		return fmt.Errorf("listing checks failed %w", err)
+	}
+
+	// a service is stale if it has checks and all of them are critical
+	stale := make(map[string]bool)
+	for _, c := range checks {
+		if c.ServiceID == "" {
+			continue
+		}
+		if _, ok := stale[c.ServiceID]; !ok {
+			stale[c.ServiceID] = true
+		}
+		if c.Status != api.HealthCritical {
+			stale[c.ServiceID] = false
+		}
+	}
+
+	for id, s := range services {
+		if s.Service != registration.Name || id == registration.ID || !stale[id] {
+			continue
+		}
+		if match != nil && !match(s) {
+			continue
+		}
+		if err := consul.Agent().ServiceDeregister(id); err != nil {
+			return fmt.Errorf("deregistering previous registration %s failed %w", id, err)
+		}
+		log.Printf("deregistered previous registration %s of %s", id, registration.Name)
+	}
+	return nil
+}
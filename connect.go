@@ -0,0 +1,124 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Upstream is a service the sidecar proxy opens a local listener for.
+type Upstream struct {
+	// DestinationName is the name of the upstream service.
+	DestinationName string
+	// LocalBindPort is the local port the application dials to reach the upstream, i.e. localhost:<LocalBindPort>.
+	LocalBindPort int
+}
+
+// WithConnectSidecar registers a connect sidecar proxy with the default settings of consul for the service,
+// so it can join the service mesh.
+func WithConnectSidecar() Option {
+	return WithRegistrationModifier(func(registration *api.AgentServiceRegistration) {
+		sidecar(registration)
+	})
+}
+
+// WithConnectUpstreams registers a connect sidecar like WithConnectSidecar with the given upstreams.
+// The mesh routes the connections to the local ports to the upstream services using mTLS.
+// The local ports have to be unique.
+func WithConnectUpstreams(upstreams []Upstream) Option {
+	return withRegistrationStep(func(registration *api.AgentServiceRegistration) error {
+		proxy := sidecar(registration).Proxy
+		ports := make(map[int]string, len(upstreams))
+		for _, u := range proxy.Upstreams {
+			ports[u.LocalBindPort] = u.DestinationName
+		}
+		proxyUpstreams := make([]api.Upstream, 0, len(upstreams))
+		for _, u := range upstreams {
+			if u.DestinationName == "" {
+				return fmt.Errorf("the upstream on port %d has no destination", u.LocalBindPort)
+			}
+			if u.LocalBindPort < 1 || u.LocalBindPort > 65535 {
+				return fmt.Errorf("invalid local port %d for the upstream %s", u.LocalBindPort, u.DestinationName)
+			}
+			if other, ok := ports[u.LocalBindPort]; ok {
+				return fmt.Errorf("the upstreams %s and %s use the same local port %d", other, u.DestinationName, u.LocalBindPort)
+			}
+			ports[u.LocalBindPort] = u.DestinationName
+			proxyUpstreams = append(proxyUpstreams, api.Upstream{
+				DestinationType: api.UpstreamDestTypeService,
+				DestinationName: u.DestinationName,
+				LocalBindPort:   u.LocalBindPort,
+			})
+		}
+
+		proxy.Upstreams = append(proxy.Upstreams, proxyUpstreams...)
+		return nil
+	})
+}
+
+// sidecar returns the sidecar registration of the service, adding it if missing.
+func sidecar(registration *api.AgentServiceRegistration) *api.AgentServiceRegistration {
+	if registration.Connect == nil {
+		registration.Connect = &api.AgentServiceConnect{}
+	}
+	if registration.Connect.SidecarService == nil {
+		registration.Connect.SidecarService = &api.AgentServiceRegistration{}
+	}
+	if registration.Connect.SidecarService.Proxy == nil {
+		registration.Connect.SidecarService.Proxy = &api.AgentServiceConnectProxyConfig{}
+	}
+	return registration.Connect.SidecarService
+}
+
+// dependsOnMetaKey is the meta key listing the dependencies of services without connect sidecars.
+const dependsOnMetaKey = "depends-on"
+
+// ServiceDependencies returns the names of the services the given service depends on, sorted and without duplicates.
+// They are taken from the upstreams of the connect sidecar proxies of all its instances.
+// For services without connect sidecars, they are taken from the "depends-on" meta data instead,
+// which holds the comma-separated service names, e.g. WithMeta("depends-on", "orders,payments").
+func ServiceDependencies(serviceName string) ([]string, error) {
+	consul, err := newClient(defaultConfig())
+	if err != nil {
+		return nil, fmt.Errorf("could not create consul client %w", err)
+	}
+
+	dependencies := make(map[string]bool)
+	proxies, _, err := consul.Catalog().Connect(serviceName, "", nil)
+	if err != nil {
+		return nil, fmt.Errorf("searching for connect proxies failed %w", err)
+	}
+	for _, p := range proxies {
+		if p.ServiceProxy == nil {
+			continue
+		}
+		for _, u := range p.ServiceProxy.Upstreams {
+			if u.DestinationType == "" || u.DestinationType == api.UpstreamDestTypeService {
+				dependencies[u.DestinationName] = true
+			}
+		}
+	}
+
+	if len(proxies) == 0 {
+		services, _, err := consul.Catalog().Service(serviceName, "", nil)
+		if err != nil {
+			return nil, fmt.Errorf("searching for service failed %w", err)
+		}
+		for _, s := range services {
+			for _, name := range strings.Split(s.ServiceMeta[dependsOnMetaKey], ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					dependencies[name] = true
+				}
+			}
+		}
+	}
+
+	names := make([]string, 0, len(dependencies))
+	for name := range dependencies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
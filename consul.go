@@ -1,112 +1,1184 @@
 package common
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/consul/api"
 )
 
 func connect() *api.Client {
+	consul, err := newClient(defaultConfig())
+	if err != nil {
+		log.Fatalf("could not create consul client %v", err)
+	}
+
+	return consul
+}
+
+// clientEnvVars are the environment variables api.DefaultConfig reads the client settings from.
+var clientEnvVars = []string{
+	"CONSUL_HOST", "CONSUL_HOSTS", api.HTTPAddrEnvName, api.HTTPTokenEnvName, api.HTTPTokenFileEnvName,
+	api.HTTPAuthEnvName, api.HTTPSSLEnvName, api.HTTPSSLVerifyEnvName, api.HTTPCAFile, api.HTTPCAPath,
+	api.HTTPClientCert, api.HTTPClientKey, api.HTTPTLSServerName, api.HTTPNamespaceEnvName, api.HTTPPartitionEnvName,
+}
+
+// clientKey identifies the effective connection settings of a config.
+type clientKey struct {
+	env          string
+	agentAddress string
+	addresses    string
+	httpClient   *http.Client
+	token        string
+	datacenter   string
+	apiRetries   int
+	retryWaitMin time.Duration
+	retryWaitMax time.Duration
+	headers      string
+	serviceName  string
+}
+
+func newClientKey(cfg *config) clientKey {
+	env := make([]string, 0, len(clientEnvVars))
+	for _, name := range clientEnvVars {
+		env = append(env, os.Getenv(name))
+	}
+	headers := make([]string, 0, len(cfg.headers))
+	for name, values := range cfg.headers {
+		headers = append(headers, http.CanonicalHeaderKey(name)+"="+strings.Join(values, ","))
+	}
+	sort.Strings(headers)
+
+	token := cfg.token
+	if cfg.callToken != "" {
+		token = cfg.callToken
+	}
+	return clientKey{
+		env:          strings.Join(env, "\x00"),
+		agentAddress: cfg.agentAddress,
+		addresses:    strings.Join(cfg.consulAddressPool, ","),
+		httpClient:   cfg.httpClient,
+		token:        token,
+		datacenter:   cfg.datacenter,
+		apiRetries:   cfg.apiRetries,
+		retryWaitMin: cfg.apiRetryWaitMin,
+		retryWaitMax: cfg.apiRetryWaitMax,
+		headers:      strings.Join(headers, "\x00"),
+		serviceName:  cfg.serviceName,
+	}
+}
+
+var (
+	clientsMu sync.Mutex
+	// clients holds the created clients by their connection settings, so their connection pools get reused.
+	clients = make(map[clientKey]*api.Client)
+)
+
+// newClient returns the consul client of the config.
+// Unless a client was passed with WithClient, it creates one using the first set of the addresses
+// from WithConsulAddresses, the address from WithAgentAddress, the addresses from CONSUL_HOSTS
+// and the address from CONSUL_HOST. Clients are shared by all configs with the same connection settings.
+func newClient(cfg *config) (*api.Client, error) {
+	if cfg.optionErr != nil {
+		return nil, cfg.optionErr
+	}
+	if cfg.client != nil {
+		return cfg.client, nil
+	}
+
+	key := newClientKey(cfg)
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	if consul, ok := clients[key]; ok {
+		return consul, nil
+	}
+	consul, err := createClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	clients[key] = consul
+	return consul, nil
+}
+
+// createClient creates a new consul client with the settings of the config.
+func createClient(cfg *config) (*api.Client, error) {
 	config := api.DefaultConfig()
 	consulHost := os.Getenv("CONSUL_HOST")
 	if consulHost != "" {
 		config.Address = consulHost
 	}
+	if cfg.agentAddress != "" {
+		config.Address = cfg.agentAddress
+	}
+	if cfg.httpClient != nil {
+		config.HttpClient = cfg.httpClient
+	}
+	if cfg.token != "" {
+		config.Token = cfg.token
+	}
+	if cfg.callToken != "" {
+		config.Token = cfg.callToken
+	}
+	if cfg.datacenter != "" {
+		config.Datacenter = cfg.datacenter
+	}
+	if addrs := cfg.consulAddresses(); len(addrs) > 0 {
+		config.Scheme, config.Address = splitAddress(addrs[0])
+		if config.Scheme == "" {
+			config.Scheme = "http"
+		}
+		err := wrapTransport(config, func(base http.RoundTripper) http.RoundTripper {
+			return &failoverTransport{addrs: addrs, base: base}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.apiRetries > 0 {
+		err := wrapTransport(config, func(base http.RoundTripper) http.RoundTripper {
+			return &retryTransport{retries: cfg.apiRetries, waitMin: cfg.apiRetryWaitMin, waitMax: cfg.apiRetryWaitMax, base: base}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	consul, err := api.NewClient(config)
 	if err != nil {
-		log.Fatalf("could not create consul client %v", err)
+		return nil, err
+	}
+	headers := http.Header{"User-Agent": {userAgent(cfg.serviceName)}}
+	for name, values := range cfg.headers {
+		headers[http.CanonicalHeaderKey(name)] = values
 	}
+	consul.SetHeaders(headers)
+	return consul, nil
+}
 
-	return consul
+// wrapTransport wraps the transport of the http client of the config, creating the client if needed.
+func wrapTransport(config *api.Config, wrap func(http.RoundTripper) http.RoundTripper) error {
+	client := config.HttpClient
+	if client == nil {
+		var err error
+		client, err = api.NewHttpClient(config.Transport, config.TLSConfig)
+		if err != nil {
+			return err
+		}
+	} else {
+		c := *client
+		client = &c
+	}
+	if client.Transport == nil {
+		client.Transport = http.DefaultTransport
+	}
+	client.Transport = wrap(client.Transport)
+	config.HttpClient = client
+	return nil
 }
 
+const portSelfCheckGracePeriod = 10 * time.Second
+
 type Option func(c *config)
 
 type config struct {
 	defaultPort           int
-	registrationModifiers []func(*api.AgentServiceRegistration)
+	registrationModifiers []func(*api.AgentServiceRegistration) error
+	// beforeRegister holds side effects, like starting the health webserver,
+	// which have to be executed right before the service gets registered.
+	beforeRegister []func(*api.AgentServiceRegistration) error
+	// afterRegister holds side effects, like starting background tasks,
+	// which have to be executed after the service got registered.
+	afterRegister []func(*api.AgentServiceRegistration) error
+
+	catalogRegistration bool
+	catalogFallback     bool
+	batchRollback       bool
+	nodeName            string
+	nodeAddress         string
+	initialStatus       string
+	healthCheck         HealthCheckConfig
+	discoveryAttempts   int
+	discoveryBaseDelay  time.Duration
+	client              *api.Client
+	defaultScheme       string
+	envPrefix           string
+	explicitPort        int
+	agentAddress        string
+	httpClient          *http.Client
+	consulAddressPool   []string
+	headers             http.Header
+	apiRetries          int
+	apiRetryWaitMin     time.Duration
+	apiRetryWaitMax     time.Duration
+	token               string
+	callToken           string
+	datacenter          string
+	onEmptyResult       func(serviceName string)
+	excludeUnversioned  bool
+	// checkConfigs holds the settings of single checks of the registration being built
+	checkConfigs map[*api.AgentServiceCheck][]HealthCheckConfig
+	// kvEntries get written after the registration and deleted on deregistration
+	kvEntries []*api.KVPair
+	// healthServerErrors receives the errors of the running health webserver
+	healthServerErrors func(error)
+	healthDetailPath   string
+	// deregisterCriticalAfter overrides DeregisterCriticalServiceAfter of healthCheck
+	deregisterCriticalAfter time.Duration
+	// serviceName is the name of the registered service, used for the User-Agent
+	serviceName string
+	// synced is the registration the background tasks submit, see syncedRegistration
+	synced *syncedRegistration
+	// optionErr is the error of an invalid option
+	optionErr error
+}
+
+var (
+	defaultOptionsMu sync.RWMutex
+	defaultOptions   []Option
+)
+
+// Configure sets options which get applied to every call of this package before the options of the call itself.
+// This allows configuring functions without options, e.g. the discovery functions.
+// Calling it again replaces the previously configured options.
+func Configure(options ...Option) {
+	defaultOptionsMu.Lock()
+	defer defaultOptionsMu.Unlock()
+	defaultOptions = options
 }
 
 func defaultConfig() *config {
 	cfg := &config{}
 	WithDefaultPort(8100)(cfg)
+	WithDiscoveryRetry(1, 0)(cfg)
+	WithDefaultScheme("http")(cfg)
+	WithEnvPrefix("PRODUCT")(cfg)
+
+	defaultOptionsMu.RLock()
+	defer defaultOptionsMu.RUnlock()
+	for _, o := range defaultOptions {
+		o(cfg)
+	}
 	return cfg
 }
 
 // WithDefaultPort sets the default port for the service.
-// This setting can always be overwritten by an environment variable named PRODUCT_SERVICE_PORT.
+// This setting can always be overwritten by an environment variable named PRODUCT_SERVICE_PORT (see WithEnvPrefix).
 func WithDefaultPort(defaultPort int) Option {
 	return func(o *config) {
 		o.defaultPort = defaultPort
 	}
 }
 
+// WithExplicitPort sets the port of the service bypassing the environment variable.
+// The port is taken in the order of precedence: explicit port, environment variable, default port.
+func WithExplicitPort(port int) Option {
+	return func(o *config) {
+		o.explicitPort = port
+	}
+}
+
+// WithEnvPrefix sets the prefix of the environment variables used for the ports and the scheme,
+// e.g. with the prefix PRICING the service port is read from PRICING_SERVICE_PORT. The default prefix is PRODUCT.
+// This allows running multiple services within one process.
+func WithEnvPrefix(prefix string) Option {
+	return func(o *config) {
+		o.envPrefix = prefix
+	}
+}
+
+// WithDefaultScheme sets the scheme used by ServiceURL for instances without a "scheme" meta data.
+// This setting can always be overwritten by an environment variable named PRODUCT_SERVICE_SCHEME (see WithEnvPrefix).
+// Use it with Configure to apply it to ServiceURL.
+func WithDefaultScheme(scheme string) Option {
+	return func(o *config) {
+		o.defaultScheme = scheme
+	}
+}
+
+// WithClient uses the given, already configured consul client instead of creating one.
+// It takes precedence over all other connection settings.
+// Use it with Configure to apply it to the functions without options.
+func WithClient(client *api.Client) Option {
+	return func(o *config) {
+		o.client = client
+	}
+}
+
+// WithAgentAddress uses the consul agent with the given address instead of the ones from CONSUL_HOSTS or CONSUL_HOST.
+// This allows registering services at different agents from within one process.
+func WithAgentAddress(addr string) Option {
+	return func(o *config) {
+		o.agentAddress = addr
+	}
+}
+
+// WithConsulToken uses the ACL token for the requests to consul instead of the one from CONSUL_HTTP_TOKEN.
+func WithConsulToken(token string) Option {
+	return func(o *config) {
+		o.token = token
+	}
+}
+
+// WithToken uses the ACL token for the requests of this call only, e.g. the registration or the deregistration,
+// overriding the token of the client. Unlike WithConsulToken, it also applies to a client passed by WithClient,
+// except for registrations at the agent, whose API doesn't accept a token per request.
+func WithToken(token string) Option {
+	return func(o *config) {
+		o.callToken = token
+	}
+}
+
+// writeOptions returns the write options of the call.
+func (c *config) writeOptions() *api.WriteOptions {
+	return &api.WriteOptions{Token: c.callToken}
+}
+
+// queryOptions returns the query options of the call.
+func (c *config) queryOptions() *api.QueryOptions {
+	return &api.QueryOptions{Token: c.callToken}
+}
+
+// WithDatacenter sends the requests to the given datacenter instead of the one of the agent.
+func WithDatacenter(datacenter string) Option {
+	return func(o *config) {
+		o.datacenter = datacenter
+	}
+}
+
+// WithHTTPClient uses the given http client for the requests to consul, e.g. to use a proxy
+// or to tune the connection pool.
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *config) {
+		if client == nil {
+			o.optionErr = errors.New("the http client must not be nil")
+			return
+		}
+		o.httpClient = client
+	}
+}
+
+// WithConsulHeaders sends the headers with every request to consul. The User-Agent defaults to the name
+// of the registered service and the version of this library, e.g. "pricing common-go/v1.2.0".
+// Calls which don't know the service name, e.g. the discovery and the deregistration, use the name of the executable.
+// It doesn't apply to clients passed with WithClient.
+func WithConsulHeaders(h http.Header) Option {
+	return func(o *config) {
+		o.headers = h
+	}
+}
+
+// WithDiscoveryRetry retries failed discovery calls up to maxAttempts times in total.
+// The delay between the attempts starts at baseDelay, grows exponentially and is jittered.
+// Only errors are retried, an empty result is a valid answer.
+// Use it with Configure to apply it to the discovery functions.
+func WithDiscoveryRetry(maxAttempts int, baseDelay time.Duration) Option {
+	return func(o *config) {
+		if maxAttempts < 1 {
+			maxAttempts = 1
+		}
+		o.discoveryAttempts = maxAttempts
+		o.discoveryBaseDelay = baseDelay
+	}
+}
+
+// WithOnEmptyResult calls the hook whenever a discovery call succeeds without any instance, e.g. to alert on it.
+// Failed discovery calls don't trigger it but return their error.
+// Use it with Configure to apply it to the discovery functions.
+func WithOnEmptyResult(hook func(serviceName string)) Option {
+	return func(o *config) {
+		o.onEmptyResult = hook
+	}
+}
+
 func WithRegistrationModifier(modifier func(*api.AgentServiceRegistration)) Option {
+	return withRegistrationStep(func(registration *api.AgentServiceRegistration) error {
+		modifier(registration)
+		return nil
+	})
+}
+
+// withRegistrationStep adds a registration modifier which may fail.
+func withRegistrationStep(step func(*api.AgentServiceRegistration) error) Option {
+	return func(o *config) {
+		o.registrationModifiers = append(o.registrationModifiers, step)
+	}
+}
+
+// withAfterRegister adds a side effect which gets executed after the service got registered.
+func withAfterRegister(hook func(*api.AgentServiceRegistration) error) Option {
 	return func(o *config) {
-		o.registrationModifiers = append(o.registrationModifiers, modifier)
+		o.afterRegister = append(o.afterRegister, hook)
+	}
+}
+
+// withBeforeRegister adds a side effect which gets executed right before the service gets registered.
+func withBeforeRegister(hook func(*api.AgentServiceRegistration) error) Option {
+	return func(o *config) {
+		o.beforeRegister = append(o.beforeRegister, hook)
+	}
+}
+
+// WithTags adds the given tags to the registration.
+func WithTags(tags ...string) Option {
+	return WithRegistrationModifier(func(registration *api.AgentServiceRegistration) {
+		registration.Tags = append(registration.Tags, tags...)
+	})
+}
+
+// WithEnableTagOverride allows changing the tags of the service externally using the catalog api
+// without the agent reverting them on its next anti-entropy sync.
+// The tags set by WithTags are only the initial tags then; a re-registration resets them to those.
+func WithEnableTagOverride() Option {
+	return WithRegistrationModifier(func(registration *api.AgentServiceRegistration) {
+		registration.EnableTagOverride = true
+	})
+}
+
+// WithMeta adds the given key-value pair to the meta data of the registration.
+func WithMeta(key, value string) Option {
+	return WithRegistrationModifier(func(registration *api.AgentServiceRegistration) {
+		if registration.Meta == nil {
+			registration.Meta = make(map[string]string)
+		}
+		registration.Meta[key] = value
+	})
+}
+
+// WithNamedPort registers an additional port of the service, e.g. for metrics, as meta data "<name>_port".
+// Clients can read it using GetServicePort.
+func WithNamedPort(name string, port int) Option {
+	return withRegistrationStep(func(registration *api.AgentServiceRegistration) error {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("invalid port %d for %s", port, name)
+		}
+		if registration.Meta == nil {
+			registration.Meta = make(map[string]string)
+		}
+		registration.Meta[name+"_port"] = strconv.Itoa(port)
+		return nil
+	})
+}
+
+// WithRegisterKV writes the KV entry after the service got registered successfully.
+// Passing the same option to DeregisterConsulService deletes the entry again.
+func WithRegisterKV(key string, value []byte) Option {
+	return func(o *config) {
+		o.kvEntries = append(o.kvEntries, &api.KVPair{Key: key, Value: value})
+	}
+}
+
+// WithTaggedAddress adds an address with the given name, e.g. "lan" or "wan", to the registration.
+// Clients can resolve the tagged address instead of the default one, e.g. clients from other datacenters.
+func WithTaggedAddress(name, address string, port int) Option {
+	return WithRegistrationModifier(func(registration *api.AgentServiceRegistration) {
+		if registration.TaggedAddresses == nil {
+			registration.TaggedAddresses = make(map[string]api.ServiceAddress)
+		}
+		registration.TaggedAddresses[name] = api.ServiceAddress{Address: address, Port: port}
+	})
+}
+
+// WithTagsFromEnv adds the tags from the given environment variable to the registration.
+// The tags are separated by commas, e.g. PRODUCT_SERVICE_TAGS=v2,canary.
+func WithTagsFromEnv(varName string) Option {
+	return WithRegistrationModifier(func(registration *api.AgentServiceRegistration) {
+		for _, tag := range strings.Split(os.Getenv(varName), ",") {
+			tag = strings.TrimSpace(tag)
+			if tag != "" {
+				registration.Tags = append(registration.Tags, tag)
+			}
+		}
+	})
+}
+
+// WithMetaFromEnv adds the meta data from the given environment variable to the registration.
+// The key-value pairs are separated by commas, e.g. PRODUCT_SERVICE_META=region=eu,build=abc123.
+func WithMetaFromEnv(varName string) Option {
+	return withRegistrationStep(func(registration *api.AgentServiceRegistration) error {
+		for _, pair := range strings.Split(os.Getenv(varName), ",") {
+			if strings.TrimSpace(pair) == "" {
+				continue
+			}
+			kv := strings.SplitN(pair, "=", 2)
+			key := strings.TrimSpace(kv[0])
+			if len(kv) != 2 || key == "" {
+				return fmt.Errorf("invalid meta pair %q in the environment variable %s", pair, varName)
+			}
+			if registration.Meta == nil {
+				registration.Meta = make(map[string]string)
+			}
+			registration.Meta[key] = strings.TrimSpace(kv[1])
+		}
+		return nil
+	})
+}
+
+// WithTaggedAddressFromEnv adds a tagged address like WithTaggedAddress with the address read from the given
+// environment variable, e.g. the DNS name of a kubernetes service. The tagged address is skipped if the variable isn't set.
+func WithTaggedAddressFromEnv(name, varName string, port int) Option {
+	return withRegistrationStep(func(registration *api.AgentServiceRegistration) error {
+		address := strings.TrimSpace(os.Getenv(varName))
+		if address == "" {
+			return nil
+		}
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("invalid port %d for the tagged address %s", port, name)
+		}
+		if registration.TaggedAddresses == nil {
+			registration.TaggedAddresses = make(map[string]api.ServiceAddress)
+		}
+		registration.TaggedAddresses[name] = api.ServiceAddress{Address: address, Port: port}
+		return nil
+	})
+}
+
+// WithSocketPath registers the service as listening on the unix socket with the given path instead of a TCP port.
+// The port and address of the registration get cleared as consul requires, so it can't be combined with a TCP port.
+// Checks connecting to the service need an explicit host and port, e.g. using HealthCheckConfig, as there is no service address to fall back to.
+func WithSocketPath(path string) Option {
+	return func(o *config) {
+		withRegistrationStep(func(registration *api.AgentServiceRegistration) error {
+			name := o.envPrefix + "_SERVICE_PORT"
+			if o.explicitPort > 0 || strings.TrimSpace(os.Getenv(name)) != "" {
+				return fmt.Errorf("a socket path can't be combined with an explicit port or the service port from %s", name)
+			}
+			registration.SocketPath = path
+			registration.Port = 0
+			registration.Address = ""
+			return nil
+		})(o)
 	}
 }
 
 // WithHTTPHealthCheck enables a health check using a simple small webserver
 // which gets automatically started.
-// The default port setting can always be overwritten by an environment variable named PRODUCT_HEALTH_PORT.
-func WithHTTPHealthCheck(defaultPort int) Option {
-	return WithRegistrationModifier(func(registration *api.AgentServiceRegistration) {
-		// setup simple health detection using a small webserver
-		registration.Check = new(api.AgentServiceCheck)
-		registration.Check.HTTP = fmt.Sprintf("http://%s:%d/healthcheck", registration.Address, healthPort(defaultPort))
-		registration.Check.Interval = "5s"
-		registration.Check.Timeout = "3s"
-		http.HandleFunc("/healthcheck", func(w http.ResponseWriter, r *http.Request) {
-			_, err := fmt.Fprintf(w, `I am alive!`)
-			if err != nil {
-				panic(err)
+// The default port setting can always be overwritten by an environment variable named PRODUCT_HEALTH_PORT (see WithEnvPrefix).
+func WithHTTPHealthCheck(defaultPort int, checkConfig ...HealthCheckConfig) Option {
+	return func(o *config) {
+		WithRegistrationModifier(func(registration *api.AgentServiceRegistration) {
+			// setup simple health detection using a small webserver
+			addConfiguredCheck(o, registration, &api.AgentServiceCheck{
+				HTTP:     fmt.Sprintf("http://%s:%d/healthcheck", registration.Address, o.healthPort(defaultPort)),
+				Interval: "5s",
+				Timeout:  "3s",
+			}, checkConfig)
+		})(o)
+		withBeforeRegister(func(registration *api.AgentServiceRegistration) error {
+			return startHealthServer(o.healthPort(defaultPort), nil, o)
+		})(o)
+	}
+}
+
+// WithHealthServerErrorHandler sets a handler for errors of the health webserver after it started,
+// e.g. to terminate the service. Errors are logged by default.
+// Errors while binding the port are returned by RegisterConsulServiceE instead.
+func WithHealthServerErrorHandler(handler func(error)) Option {
+	return func(o *config) {
+		o.healthServerErrors = handler
+	}
+}
+
+// WithHealthOnServicePort adds the health handler to the given mux of the service and
+// points the health check to the service port instead of starting a separate health webserver.
+func WithHealthOnServicePort(mux *http.ServeMux, checkConfig ...HealthCheckConfig) Option {
+	return func(o *config) {
+		WithRegistrationModifier(func(registration *api.AgentServiceRegistration) {
+			addConfiguredCheck(o, registration, &api.AgentServiceCheck{
+				HTTP:     fmt.Sprintf("http://%s:%d/healthcheck", registration.Address, registration.Port),
+				Interval: "5s",
+				Timeout:  "3s",
+			}, checkConfig)
+		})(o)
+		withBeforeRegister(func(registration *api.AgentServiceRegistration) error {
+			handleHealth(mux, o.detailPath())
+			return nil
+		})(o)
+	}
+}
+
+// WithHTTPSHealthCheck enables a health check like WithHTTPHealthCheck but serves the
+// health webserver over TLS using the given config.
+// As the certificate is usually not issued for the advertised address, consul skips its verification
+// unless the name of the certificate is set as TLSServerName of WithHealthCheckConfig.
+// The default port setting can always be overwritten by an environment variable named PRODUCT_HEALTH_PORT (see WithEnvPrefix).
+func WithHTTPSHealthCheck(defaultPort int, tlsConfig *tls.Config, checkConfig ...HealthCheckConfig) Option {
+	return func(o *config) {
+		WithRegistrationModifier(func(registration *api.AgentServiceRegistration) {
+			addConfiguredCheck(o, registration, &api.AgentServiceCheck{
+				HTTP:          fmt.Sprintf("https://%s:%d/healthcheck", registration.Address, o.healthPort(defaultPort)),
+				Interval:      "5s",
+				Timeout:       "3s",
+				TLSSkipVerify: true,
+			}, checkConfig)
+		})(o)
+		withBeforeRegister(func(registration *api.AgentServiceRegistration) error {
+			if tlsConfig == nil || (len(tlsConfig.Certificates) == 0 && tlsConfig.GetCertificate == nil) {
+				return errors.New("the tls config of the https health check has no certificates")
 			}
-		})
+			return startHealthServer(o.healthPort(defaultPort), tlsConfig, o)
+		})(o)
+	}
+}
 
-		go func() {
-			err := http.ListenAndServe(fmt.Sprintf(":%d", healthPort(defaultPort)), nil)
-			log.Fatalf("healthcheck webserver failed %v", err)
-		}()
+// WithPortSelfCheck verifies that something is listening on the advertised service port before registering.
+// The registration fails if the port isn't reachable within the grace period of 10 seconds.
+func WithPortSelfCheck() Option {
+	return withBeforeRegister(func(registration *api.AgentServiceRegistration) error {
+		address := net.JoinHostPort(registration.Address, strconv.Itoa(registration.Port))
+		deadline := time.Now().Add(portSelfCheckGracePeriod)
+		for {
+			conn, err := net.DialTimeout("tcp", address, time.Second)
+			if err == nil {
+				return conn.Close()
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("nothing is listening on the service port %s %w", address, err)
+			}
+			time.Sleep(250 * time.Millisecond)
+		}
 	})
 }
 
+// WithInitialStatus sets the status the checks of the service start with. By default consul starts them as critical,
+// which drops slow starting services from the rotation until their first check passed.
+//
+// Consul has no delay before the first probe. Note that a failing probe immediately overrides the initial status
+// unless FailuresBeforeCritical is set on the check, so an optimistic "passing" status only bridges the startup
+// for FailuresBeforeCritical times the check interval.
+func WithInitialStatus(status string) Option {
+	return func(o *config) {
+		o.initialStatus = status
+	}
+}
+
+// applyCheckDefaults applies the settings for all checks to the checks of the registration.
+func applyCheckDefaults(registration *api.AgentServiceRegistration, cfg *config) error {
+	switch cfg.initialStatus {
+	case "", api.HealthPassing, api.HealthWarning, api.HealthCritical:
+	default:
+		return fmt.Errorf("invalid initial check status %s", cfg.initialStatus)
+	}
+
+	for _, check := range checks(registration) {
+		if cfg.initialStatus != "" {
+			check.Status = cfg.initialStatus
+		}
+		cfg.healthCheck.apply(check)
+		if cfg.deregisterCriticalAfter > 0 {
+			check.DeregisterCriticalServiceAfter = cfg.deregisterCriticalAfter.String()
+		}
+		for _, c := range cfg.checkConfigs[check] {
+			c.apply(check)
+		}
+	}
+	return nil
+}
+
+// checks returns all checks of the registration.
+func checks(registration *api.AgentServiceRegistration) api.AgentServiceChecks {
+	if registration.Check == nil {
+		return registration.Checks
+	}
+	return append(api.AgentServiceChecks{registration.Check}, registration.Checks...)
+}
+
+// WithScriptHealthCheck adds a check running the given command on the host of the consul agent.
+// Consul only runs script checks if they are enabled in the agent config (enable_local_script_checks).
+func WithScriptHealthCheck(args []string, interval, timeout string, checkConfig ...HealthCheckConfig) Option {
+	return func(o *config) {
+		WithRegistrationModifier(func(registration *api.AgentServiceRegistration) {
+			addConfiguredCheck(o, registration, &api.AgentServiceCheck{
+				Args:     args,
+				Interval: interval,
+				Timeout:  timeout,
+			}, checkConfig)
+		})(o)
+	}
+}
+
+// WithTTLHealthCheck adds a TTL check with the ID "service:<service id>:ttl" which gets updated in the background
+// with the result of the registered health checkers. The output of the check contains the errors of the failed checkers.
+// The check can also be updated manually using UpdateTTL.
+func WithTTLHealthCheck(ttl time.Duration, checkConfig ...HealthCheckConfig) Option {
+	return func(o *config) {
+		WithRegistrationModifier(func(registration *api.AgentServiceRegistration) {
+			addConfiguredCheck(o, registration, &api.AgentServiceCheck{
+				CheckID: ttlCheckID(registration.ID),
+				TTL:     ttl.String(),
+			}, checkConfig)
+		})(o)
+		withAfterRegister(func(registration *api.AgentServiceRegistration) error {
+			consul, err := newClient(o)
+			if err != nil {
+				return fmt.Errorf("could not create consul client %w", err)
+			}
+			checkID := ttlCheckID(registration.ID)
+			startBackground(registration.ID, func(ctx context.Context) {
+				heartbeat(ctx, consul, checkID, ttl)
+			})
+			return nil
+		})(o)
+	}
+}
+
+func ttlCheckID(serviceID string) string {
+	return fmt.Sprintf("service:%s:ttl", serviceID)
+}
+
+// WithTCPHealthCheck adds a check connecting to the given port of the service address.
+// The service port is used if the port is 0.
+func WithTCPHealthCheck(port int, checkConfig ...HealthCheckConfig) Option {
+	return func(o *config) {
+		WithRegistrationModifier(func(registration *api.AgentServiceRegistration) {
+			checkPort := port
+			if checkPort == 0 {
+				checkPort = registration.Port
+			}
+			addConfiguredCheck(o, registration, &api.AgentServiceCheck{
+				TCP:      fmt.Sprintf("%s:%d", registration.Address, checkPort),
+				Interval: "5s",
+				Timeout:  "3s",
+			}, checkConfig)
+		})(o)
+	}
+}
+
+// WithGRPCHealthCheck adds a check using the gRPC health checking protocol on the given port of the service address.
+// The service port is used if the port is 0.
+func WithGRPCHealthCheck(port int, checkConfig ...HealthCheckConfig) Option {
+	return func(o *config) {
+		WithRegistrationModifier(func(registration *api.AgentServiceRegistration) {
+			checkPort := port
+			if checkPort == 0 {
+				checkPort = registration.Port
+			}
+			addConfiguredCheck(o, registration, &api.AgentServiceCheck{
+				GRPC:     fmt.Sprintf("%s:%d", registration.Address, checkPort),
+				Interval: "5s",
+				Timeout:  "3s",
+			}, checkConfig)
+		})(o)
+	}
+}
+
+// WithH2PingHealthCheck adds a check sending HTTP/2 pings to the given port of the service address,
+// a lighter alternative to WithGRPCHealthCheck for services speaking HTTP/2 without the gRPC health protocol.
+// The service port is used if the port is 0. Without TLS the check uses h2c.
+func WithH2PingHealthCheck(port int, useTLS bool, checkConfig ...HealthCheckConfig) Option {
+	return func(o *config) {
+		WithRegistrationModifier(func(registration *api.AgentServiceRegistration) {
+			checkPort := port
+			if checkPort == 0 {
+				checkPort = registration.Port
+			}
+			addConfiguredCheck(o, registration, &api.AgentServiceCheck{
+				H2PING:       fmt.Sprintf("%s:%d", registration.Address, checkPort),
+				H2PingUseTLS: useTLS,
+				Interval:     "5s",
+				Timeout:      "3s",
+			}, checkConfig)
+		})(o)
+	}
+}
+
+// WithHealthCheckFromEnv configures the check type read from the given environment variable.
+// Valid values are http (see WithHTTPHealthCheck), tcp, grpc and none. The port of the check is read
+// from the variable with the suffix _PORT, e.g. HEALTH_CHECK_PORT for HEALTH_CHECK.
+// Without it, http checks use the port 8101 and tcp and grpc checks the service port.
+// An unset or blank variable means none, so other check options can provide the default.
+// The registration fails for other values.
+func WithHealthCheckFromEnv(varName string) Option {
+	return func(o *config) {
+		checkType := strings.ToLower(strings.TrimSpace(os.Getenv(varName)))
+		if checkType == "" || checkType == "none" {
+			return
+		}
+
+		port := 0
+		portVar := varName + "_PORT"
+		if p := strings.TrimSpace(os.Getenv(portVar)); p != "" {
+			var err error
+			port, err = strconv.Atoi(p)
+			if err != nil || port <= 0 {
+				o.optionErr = fmt.Errorf("invalid port %q in the environment variable %s", p, portVar)
+				return
+			}
+		}
+
+		switch checkType {
+		case "http":
+			if port == 0 {
+				port = 8101
+			}
+			WithHTTPHealthCheck(port)(o)
+		case "tcp":
+			WithTCPHealthCheck(port)(o)
+		case "grpc":
+			WithGRPCHealthCheck(port)(o)
+		default:
+			o.optionErr = fmt.Errorf("invalid health check type %q in the environment variable %s, expected http, tcp, grpc or none", checkType, varName)
+		}
+	}
+}
+
+// WithPeriodicResync registers the service again every interval in the background, in case the catalog
+// lost it despite a running agent. The interval is jittered by up to 10% in both directions, so the instances don't resync at once.
+// The resync stops on deregistration.
+func WithPeriodicResync(interval time.Duration) Option {
+	return func(o *config) {
+		if interval <= 0 {
+			o.optionErr = errors.New("the resync interval has to be positive")
+			return
+		}
+		withAfterRegister(func(registration *api.AgentServiceRegistration) error {
+			consul, err := newClient(o)
+			if err != nil {
+				return fmt.Errorf("could not create consul client %w", err)
+			}
+			synced := o.syncedRegistration(registration)
+			startBackground(registration.ID, func(ctx context.Context) {
+				for {
+					jitter := time.Duration(rand.Int63n(int64(interval)/5 + 1))
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(interval - interval/10 + jitter):
+					}
+					err := synced.update(func(current *api.AgentServiceRegistration) (*api.AgentServiceRegistration, error) {
+						return current, submitRegistration(consul, current, o)
+					})
+					if err != nil {
+						log.Printf("resyncing registration failed %v", err)
+					}
+				}
+			})
+			return nil
+		})(o)
+	}
+}
+
+// WithDynamicWeight advertises the weight returned by the function as the passing weight of the instance,
+// e.g. proportional to its free capacity, so weighted selection reflects the live load.
+// The weight is recomputed every interval and the service gets re-registered only if it changed,
+// which limits the updates of the catalog to one per interval. Weights below 1 are raised to 1.
+// WithPeriodicResync re-registers the last advertised weight.
+func WithDynamicWeight(interval time.Duration, weight func() int) Option {
+	return func(o *config) {
+		if interval <= 0 {
+			o.optionErr = errors.New("the weight interval has to be positive")
+			return
+		}
+		WithRegistrationModifier(func(registration *api.AgentServiceRegistration) {
+			registration.Weights = &api.AgentWeights{Passing: dynamicWeight(weight), Warning: 1}
+		})(o)
+		withAfterRegister(func(registration *api.AgentServiceRegistration) error {
+			consul, err := newClient(o)
+			if err != nil {
+				return fmt.Errorf("could not create consul client %w", err)
+			}
+			synced := o.syncedRegistration(registration)
+			startBackground(registration.ID, func(ctx context.Context) {
+				ticker := time.NewTicker(interval)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case <-ticker.C:
+					}
+					w := dynamicWeight(weight)
+					err := synced.update(func(current *api.AgentServiceRegistration) (*api.AgentServiceRegistration, error) {
+						if current.Weights != nil && current.Weights.Passing == w {
+							return current, nil
+						}
+						updated := *current
+						updated.Weights = &api.AgentWeights{Passing: w, Warning: 1}
+						if err := submitRegistration(consul, &updated, o); err != nil {
+							return current, err
+						}
+						return &updated, nil
+					})
+					if err != nil {
+						log.Printf("updating weight failed %v", err)
+					}
+				}
+			})
+			return nil
+		})(o)
+	}
+}
+
+// syncedRegistration is the registration last submitted by the background tasks of a service,
+// so a resync doesn't revert the changes of another task, e.g. the weight of WithDynamicWeight.
+type syncedRegistration struct {
+	mu           sync.Mutex
+	registration *api.AgentServiceRegistration
+}
+
+// syncedRegistration returns the registration shared by the background tasks of the registration.
+func (c *config) syncedRegistration(registration *api.AgentServiceRegistration) *syncedRegistration {
+	if c.synced == nil {
+		c.synced = &syncedRegistration{registration: registration}
+	}
+	return c.synced
+}
+
+// update replaces the registration with the one returned by the function, which runs exclusively.
+func (s *syncedRegistration) update(f func(current *api.AgentServiceRegistration) (*api.AgentServiceRegistration, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	updated, err := f(s.registration)
+	s.registration = updated
+	return err
+}
+
+// dynamicWeight returns the weight of the function, at least 1.
+func dynamicWeight(weight func() int) int {
+	if w := weight(); w > 1 {
+		return w
+	}
+	return 1
+}
+
+// WithConflictDetection prevents silently overwriting another instance which uses the same service ID,
+// e.g. because two pods use the same hostname. The registration fails if the ID is already registered
+// with a different address.
+func WithConflictDetection() Option {
+	return func(o *config) {
+		withBeforeRegister(func(registration *api.AgentServiceRegistration) error {
+			consul, err := newClient(o)
+			if err != nil {
+				return fmt.Errorf("could not create consul client %w", err)
+			}
+
+			services, _, err := consul.Catalog().Service(registration.Name, "", nil)
+			if err != nil {
+				return fmt.Errorf("searching for service failed %w", err)
+			}
+			for _, s := range services {
+				address := s.ServiceAddress
+				if address == "" {
+					address = s.Address
+				}
+				if s.ServiceID == registration.ID && address != registration.Address {
+					return fmt.Errorf("the service ID %s is already registered with the address %s", registration.ID, address)
+				}
+			}
+			return nil
+		})(o)
+	}
+}
+
+// addConfiguredCheck adds the check like addCheck. Its own settings get applied after the ones of WithHealthCheckConfig.
+func addConfiguredCheck(o *config, registration *api.AgentServiceRegistration, check *api.AgentServiceCheck, checkConfig []HealthCheckConfig) {
+	addCheck(registration, check)
+	if len(checkConfig) > 0 {
+		o.checkConfigs[check] = checkConfig
+	}
+}
+
+// addCheck adds the check to the registration keeping already existing checks.
+func addCheck(registration *api.AgentServiceRegistration, check *api.AgentServiceCheck) {
+	if registration.Check == nil {
+		registration.Check = check
+		return
+	}
+	registration.Checks = append(registration.Checks, check)
+}
+
 // RegisterConsulService registers a new service to consul and returns the final (already registered) registration.
+//
+// Registering is idempotent: calling it again with the same service ID replaces the existing
+// registration, including its tags, meta data and checks, instead of merging into it.
+// The health webserver of WithHTTPHealthCheck is started only once per port.
+// It terminates the process if the registration fails, use RegisterConsulServiceE to handle the error instead.
 func RegisterConsulService(serviceName string, options ...Option) *api.AgentServiceRegistration {
+	registration, err := RegisterConsulServiceE(serviceName, options...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return registration
+}
+
+// RegisterConsulServiceE registers the service like RegisterConsulService but returns the error
+// instead of terminating the process, e.g. if the port of the health webserver is already in use.
+func RegisterConsulServiceE(serviceName string, options ...Option) (*api.AgentServiceRegistration, error) {
 	cfg := defaultConfig()
 	for _, o := range options {
 		o(cfg)
 	}
+	return register(serviceName, cfg)
+}
 
+// register builds the registration from the config and registers it to consul.
+func register(serviceName string, cfg *config) (*api.AgentServiceRegistration, error) {
+	cfg.serviceName = serviceName
 	// connect to consul
-	consul := connect()
+	consul, err := newClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("could not create consul client %w", err)
+	}
+
+	registration, err := buildRegistration(serviceName, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, h := range cfg.beforeRegister {
+		if err := h(registration); err != nil {
+			return nil, fmt.Errorf("preparing registration failed %w", err)
+		}
+	}
+
+	// finally register the service
+	if err := submitRegistration(consul, registration, cfg); err != nil {
+		return nil, err
+	}
+
+	// the background tasks of a previous registration with the same ID get replaced
+	stopBackground(registration.ID)
+	for _, h := range cfg.afterRegister {
+		if err := h(registration); err != nil {
+			return nil, fmt.Errorf("finishing registration failed %w", err)
+		}
+	}
+
+	for _, pair := range cfg.kvEntries {
+		if _, err := consul.KV().Put(pair, cfg.writeOptions()); err != nil {
+			return nil, fmt.Errorf("writing kv entry %s failed %w", pair.Key, err)
+		}
+	}
+
+	return registration, nil
+}
+
+// submitRegistration registers the service at the agent or in the catalog depending on the config.
+func submitRegistration(consul *api.Client, registration *api.AgentServiceRegistration, cfg *config) error {
+	if cfg.catalogRegistration {
+		return registerInCatalog(consul, registration, cfg)
+	}
+
+	if cfg.callToken != "" && cfg.client != nil {
+		return errors.New("registering to consul failed WithToken can't be combined with WithClient for agent registrations")
+	}
+	err := consul.Agent().ServiceRegisterOpts(registration, api.ServiceRegisterOpts{ReplaceExistingChecks: true})
+	if err != nil && cfg.catalogFallback && isUnreachable(err) {
+		log.Printf("no consul agent reachable, registering %s in the catalog", registration.ID)
+		if err := registerInCatalog(consul, registration, cfg); err != nil {
+			return err
+		}
+		setCatalogRegistered(registration.ID, true)
+		return nil
+	}
+	if err != nil && strings.Contains(err.Error(), "Scripts are disabled") {
+		return fmt.Errorf("registering to consul failed, script checks have to be enabled in the agent config (enable_local_script_checks) %w", err)
+	}
+	if err != nil {
+		return fmt.Errorf("registering to consul failed %w", err)
+	}
+	if cfg.catalogFallback {
+		log.Printf("registered %s at the consul agent", registration.ID)
+		setCatalogRegistered(registration.ID, false)
+	}
+	return nil
+}
+
+func registerInCatalog(consul *api.Client, registration *api.AgentServiceRegistration, cfg *config) error {
+	catalog, err := catalogRegistration(registration, cfg)
+	if err != nil {
+		return fmt.Errorf("configuring registration failed %w", err)
+	}
+	_, err = consul.Catalog().Register(catalog, cfg.writeOptions())
+	if err != nil {
+		return fmt.Errorf("registering to consul failed %w", err)
+	}
+	return nil
+}
 
-	// setup registration
+// buildRegistration builds the registration from the config without any side effects.
+func buildRegistration(serviceName string, cfg *config) (*api.AgentServiceRegistration, error) {
+	cfg.checkConfigs = make(map[*api.AgentServiceCheck][]HealthCheckConfig)
 	registration := new(api.AgentServiceRegistration)
 	registration.ID = Hostname()
 	registration.Name = serviceName
 	address := Hostname()
 	registration.Address = address
-	registration.Port = port(cfg.defaultPort)
+	registration.Port = cfg.port()
 
 	for _, m := range cfg.registrationModifiers {
-		m(registration)
+		if err := m(registration); err != nil {
+			return nil, fmt.Errorf("configuring registration failed %w", err)
+		}
 	}
 
-	// finally register the service
-	err := consul.Agent().ServiceRegister(registration)
+	if registration.SocketPath != "" && registration.Port != 0 {
+		return nil, errors.New("configuring registration failed a socket path can't be combined with a TCP port")
+	}
+
+	if err := applyCheckDefaults(registration, cfg); err != nil {
+		return nil, fmt.Errorf("configuring registration failed %w", err)
+	}
+	if err := validateRegistration(registration); err != nil {
+		return nil, fmt.Errorf("configuring registration failed %w", err)
+	}
+
+	return registration, nil
+}
+
+// DeregisterConsulService removes the service with the given ID from consul.
+// The options should match the ones used for the registration.
+// KV entries added with WithRegisterKV get deleted if the option is passed again.
+func DeregisterConsulService(serviceID string, options ...Option) error {
+	cfg := defaultConfig()
+	for _, o := range options {
+		o(cfg)
+	}
+	return deregister(serviceID, cfg)
+}
+
+// deregister removes the service with the given ID from consul using the config.
+func deregister(serviceID string, cfg *config) error {
+	return deregisterContext(context.Background(), serviceID, cfg)
+}
+
+// deregisterContext is deregister bounded by the context.
+func deregisterContext(ctx context.Context, serviceID string, cfg *config) error {
+	consul, err := newClient(cfg)
 	if err != nil {
-		log.Fatalf("registering to consul failed %v", err)
+		return fmt.Errorf("could not create consul client %w", err)
 	}
 
-	return registration
+	if cfg.catalogRegistration || catalogRegistered(serviceID) {
+		_, err = consul.Catalog().Deregister(&api.CatalogDeregistration{Node: cfg.node(), ServiceID: serviceID}, cfg.writeOptions().WithContext(ctx))
+	} else {
+		err = consul.Agent().ServiceDeregisterOpts(serviceID, cfg.queryOptions().WithContext(ctx))
+	}
+	if err != nil {
+		return fmt.Errorf("deregistering from consul failed %w", err)
+	}
+
+	stopBackground(serviceID)
+	setCatalogRegistered(serviceID, false)
+
+	for _, pair := range cfg.kvEntries {
+		if _, err := consul.KV().Delete(pair.Key, cfg.writeOptions().WithContext(ctx)); err != nil {
+			return fmt.Errorf("deleting kv entry %s failed %w", pair.Key, err)
+		}
+	}
+	return nil
 }
 
 // RegisterServiceWithConsul registers a new service to consul.
@@ -129,6 +1201,7 @@ func GetRandomServiceWithConsul(serviceName string) *api.ServiceEntry {
 }
 
 // GetServicesWithConsul returns all active services for the given name.
+// Consul always answers with the full list, so to pick the first matching instance loop over the result and break.
 func GetServicesWithConsul(serviceName string) []*api.ServiceEntry {
 	consul := connect()
 
@@ -136,48 +1209,50 @@ func GetServicesWithConsul(serviceName string) []*api.ServiceEntry {
 	if err != nil {
 		log.Fatalf("searching for service failed %v", err)
 	}
+	if cfg := defaultConfig(); len(services) == 0 && cfg.onEmptyResult != nil {
+		cfg.onEmptyResult(serviceName)
+	}
 
 	return services
 }
 
-func port(defaultPort int) int {
-	p := os.Getenv("PRODUCT_SERVICE_PORT")
-	if len(strings.TrimSpace(p)) == 0 {
-		return defaultPort
+// port returns the service port in the order of precedence: explicit port, environment variable, default port.
+func (c *config) port() int {
+	if c.explicitPort > 0 {
+		return c.explicitPort
 	}
-	port, err := strconv.Atoi(p)
-	if err != nil {
-		panic("invalid format for the environment variable PRODUCT_SERVICE_PORT")
-	}
-	return port
+	return envPort(c.envPrefix+"_SERVICE_PORT", c.defaultPort)
 }
 
-func healthPort(defaultPort int) int {
-	p := os.Getenv("PRODUCT_HEALTH_PORT")
+// healthPort returns the port of the health webserver which can be overwritten by an environment variable.
+func (c *config) healthPort(defaultPort int) int {
+	return envPort(c.envPrefix+"_HEALTH_PORT", defaultPort)
+}
+
+// envPort returns the port from the given environment variable or the default port if it isn't set.
+func envPort(name string, defaultPort int) int {
+	p := os.Getenv(name)
 	if len(strings.TrimSpace(p)) == 0 {
 		return defaultPort
 	}
 	port, err := strconv.Atoi(p)
 	if err != nil {
-		panic("invalid format for the environment variable PRODUCT_HEALTH_PORT")
+		panic(fmt.Sprintf("invalid format for the environment variable %s", name))
 	}
 	return port
 }
 
+// Port returns the service port like the registration does, including the settings of Configure, e.g. ":8100".
+//
 // Deprecation: replaced by port
 func Port() string {
-	p := os.Getenv("PRODUCT_SERVICE_PORT")
-	if len(strings.TrimSpace(p)) == 0 {
-		return ":8100"
-	}
-	return fmt.Sprintf(":%s", p)
+	return fmt.Sprintf(":%d", defaultConfig().port())
 }
 
+// HealthPort returns the port of the health webserver like WithHTTPHealthCheck(8101) does,
+// including the settings of Configure, e.g. ":8101".
+//
 // Deprecation: replaced by healthPort
 func HealthPort() string {
-	p := os.Getenv("PRODUCT_HEALTH_PORT")
-	if len(strings.TrimSpace(p)) == 0 {
-		return ":8101"
-	}
-	return fmt.Sprintf(":%s", p)
+	return fmt.Sprintf(":%d", defaultConfig().healthPort(8101))
 }
@@ -0,0 +1,243 @@
+package common
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/scayle/common-go/consultest"
+)
+
+func TestRegisterConsulServiceTwiceReplaces(t *testing.T) {
+	_, cleanup := consultest.StartTestConsul(t)
+	defer cleanup()
+
+	withID := WithRegistrationModifier(func(registration *api.AgentServiceRegistration) {
+		registration.ID = "orders-1"
+	})
+	if _, err := RegisterConsulServiceE("orders", withID, WithTags("v1", "blue"), WithMeta("version", "1.0.0"), WithMeta("zone", "a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RegisterConsulServiceE("orders", withID, WithTags("v2"), WithMeta("version", "2.0.0")); err != nil {
+		t.Fatal(err)
+	}
+
+	consul, err := newClient(defaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, _, err := consul.Catalog().Service("orders", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(services) != 1 {
+		t.Fatalf("expected a single entry, got %d", len(services))
+	}
+	s := services[0]
+	if s.ServiceID != "orders-1" {
+		t.Errorf("expected the ID orders-1, got %s", s.ServiceID)
+	}
+	if !reflect.DeepEqual(s.ServiceTags, []string{"v2"}) {
+		t.Errorf("expected the tags to be replaced, got %v", s.ServiceTags)
+	}
+	if !reflect.DeepEqual(s.ServiceMeta, map[string]string{"version": "2.0.0"}) {
+		t.Errorf("expected the meta data to be replaced, got %v", s.ServiceMeta)
+	}
+}
+
+func TestWithMetaFromEnv(t *testing.T) {
+	const varName = "COMMON_GO_TEST_META"
+	tests := []struct {
+		name    string
+		value   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "unset", want: nil},
+		{name: "pairs", value: "region=eu,build=abc123", want: map[string]string{"region": "eu", "build": "abc123"}},
+		{name: "spaces and empty pairs", value: " region = eu , ,build=", want: map[string]string{"region": "eu", "build": ""}},
+		{name: "value with equals sign", value: "query=a=b", want: map[string]string{"query": "a=b"}},
+		{name: "missing value", value: "region=eu,build", wantErr: true},
+		{name: "missing key", value: "=eu", wantErr: true},
+		{name: "blank key", value: " =eu", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.Setenv(varName, tt.value); err != nil {
+				t.Fatal(err)
+			}
+			defer os.Unsetenv(varName)
+
+			registration, err := BuildRegistration("orders", WithMetaFromEnv(varName))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got the meta data %v", registration.Meta)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(registration.Meta, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, registration.Meta)
+			}
+		})
+	}
+}
+
+// setEnv sets the environment variable until the returned function restores it.
+func setEnv(t *testing.T, name, value string) func() {
+	t.Helper()
+	previous, wasSet := os.LookupEnv(name)
+	if err := os.Setenv(name, value); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		if wasSet {
+			_ = os.Setenv(name, previous)
+		} else {
+			_ = os.Unsetenv(name)
+		}
+	}
+}
+
+func TestNewClientReusesConnections(t *testing.T) {
+	var mu sync.Mutex
+	connections := 0
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("[]"))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			connections++
+			mu.Unlock()
+		}
+	}
+	server.Start()
+	defer server.Close()
+	defer setEnv(t, "CONSUL_HOST", server.URL)()
+
+	for i := 0; i < 20; i++ {
+		if _, err := GetServiceAddresses("orders"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if connections != 1 {
+		t.Errorf("expected a single connection to consul, got %d", connections)
+	}
+}
+
+func TestWithHealthCheckFromEnv(t *testing.T) {
+	const varName = "COMMON_GO_TEST_HEALTH_CHECK"
+	tests := []struct {
+		name    string
+		value   string
+		port    string
+		want    string
+		wantErr bool
+	}{
+		{name: "unset", want: ""},
+		{name: "blank", value: "  ", want: ""},
+		{name: "blank ignores the port", value: " ", port: "invalid", want: ""},
+		{name: "none", value: "none", want: ""},
+		{name: "tcp", value: "tcp", want: "tcp"},
+		{name: "tcp with port", value: "TCP", port: "9000", want: "tcp"},
+		{name: "grpc", value: "grpc", want: "grpc"},
+		{name: "invalid port", value: "tcp", port: "invalid", wantErr: true},
+		{name: "unknown", value: "script", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.value != "" {
+				defer setEnv(t, varName, tt.value)()
+			}
+			if tt.port != "" {
+				defer setEnv(t, varName+"_PORT", tt.port)()
+			}
+
+			registration, err := BuildRegistration("orders", WithHealthCheckFromEnv(varName))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := ""
+			if c := registration.Check; c != nil {
+				if c.TCP != "" {
+					got = "tcp"
+				} else if c.GRPC != "" {
+					got = "grpc"
+				}
+			}
+			if got != tt.want {
+				t.Errorf("expected the check %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestPeriodicResyncKeepsDynamicWeight(t *testing.T) {
+	var mu sync.Mutex
+	var weights []int
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/agent/service/register" {
+			var registration api.AgentServiceRegistration
+			if err := json.NewDecoder(r.Body).Decode(&registration); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			mu.Lock()
+			weights = append(weights, registration.Weights.Passing)
+			mu.Unlock()
+		}
+	}))
+	defer agent.Close()
+	defer setEnv(t, "CONSUL_HOST", agent.URL)()
+
+	weight := int64(2)
+	registration, err := RegisterConsulServiceE("orders",
+		WithDynamicWeight(5*time.Millisecond, func() int { return int(atomic.LoadInt64(&weight)) }),
+		WithPeriodicResync(10*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt64(&weight, 5)
+	time.Sleep(100 * time.Millisecond)
+	if err := DeregisterConsulService(registration.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	updated := false
+	for _, w := range weights {
+		if w == 5 {
+			updated = true
+		} else if updated {
+			t.Fatalf("expected the resync to keep the updated weight, got the submitted weights %v", weights)
+		}
+	}
+	if !updated {
+		t.Errorf("expected the updated weight to be submitted, got %v", weights)
+	}
+}
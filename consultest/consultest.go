@@ -0,0 +1,62 @@
+// Package consultest provides helpers to test against a real, embedded consul server.
+package consultest
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/sdk/testutil"
+)
+
+// Service is a service the test server gets seeded with.
+type Service struct {
+	Name string
+	// Status of the check of the service, defaults to passing.
+	Status  string
+	Address string
+	Port    int
+	Tags    []string
+}
+
+// StartTestConsul starts a consul test server seeded with the given services and points the
+// common package to it by setting CONSUL_HOST. The cleanup function stops the server and restores CONSUL_HOST.
+// The consul binary has to be available in the PATH, otherwise the test gets skipped.
+func StartTestConsul(t *testing.T, services ...Service) (addr string, cleanup func()) {
+	t.Helper()
+
+	if _, err := exec.LookPath("consul"); err != nil {
+		t.Skip("consul binary not found in the PATH")
+	}
+
+	server, err := testutil.NewTestServerConfigT(t, nil)
+	if err != nil {
+		t.Fatalf("starting consul test server failed %v", err)
+	}
+	server.WaitForLeader(t)
+
+	for _, s := range services {
+		status := s.Status
+		if status == "" {
+			status = api.HealthPassing
+		}
+		server.AddAddressableService(t, s.Name, status, s.Address, s.Port, s.Tags)
+	}
+
+	previous, wasSet := os.LookupEnv("CONSUL_HOST")
+	if err := os.Setenv("CONSUL_HOST", server.HTTPAddr); err != nil {
+		t.Fatalf("setting CONSUL_HOST failed %v", err)
+	}
+
+	return server.HTTPAddr, func() {
+		if wasSet {
+			_ = os.Setenv("CONSUL_HOST", previous)
+		} else {
+			_ = os.Unsetenv("CONSUL_HOST")
+		}
+		if err := server.Stop(); err != nil {
+			t.Errorf("stopping consul test server failed %v", err)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/serf/coordinate"
+)
+
+// ErrNoCoordinate is returned if a node has no network coordinate (yet).
+var ErrNoCoordinate = errors.New("node has no network coordinate")
+
+// NodeRTT returns the estimated network round trip time between the two nodes
+// based on their network coordinates.
+func NodeRTT(nodeA, nodeB string) (time.Duration, error) {
+	consul, err := newClient(defaultConfig())
+	if err != nil {
+		return 0, fmt.Errorf("could not create consul client %w", err)
+	}
+
+	entries, _, err := consul.Coordinate().Nodes(nil)
+	if err != nil {
+		return 0, fmt.Errorf("retrieving network coordinates failed %w", err)
+	}
+
+	coords := make(map[string]*coordinate.Coordinate)
+	for _, e := range entries {
+		// prefer the default network segment
+		if _, ok := coords[e.Node]; !ok || e.Segment == "" {
+			coords[e.Node] = e.Coord
+		}
+	}
+
+	a, b := coords[nodeA], coords[nodeB]
+	if a == nil {
+		return 0, fmt.Errorf("%w: %s", ErrNoCoordinate, nodeA)
+	}
+	if b == nil {
+		return 0, fmt.Errorf("%w: %s", ErrNoCoordinate, nodeB)
+	}
+	if !a.IsCompatibleWith(b) {
+		return 0, fmt.Errorf("network coordinates of %s and %s are incompatible", nodeA, nodeB)
+	}
+
+	return a.DistanceTo(b), nil
+}
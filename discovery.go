@@ -0,0 +1,356 @@
+package common
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// GetServicesWithNodeMeta returns all active services for the given name
+// which run on nodes matching all the given node metadata.
+func GetServicesWithNodeMeta(serviceName string, nodeMeta map[string]string) ([]*api.ServiceEntry, error) {
+	return queryServices(serviceName, &api.QueryOptions{NodeMeta: nodeMeta})
+}
+
+// GetServiceAddresses returns the addresses (host:port) of all active services for the given name.
+func GetServiceAddresses(serviceName string) ([]string, error) {
+	services, err := queryServices(serviceName, &api.QueryOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := make([]string, 0, len(services))
+	for _, s := range services {
+		addresses = append(addresses, entryHostPort(s))
+	}
+	return addresses, nil
+}
+
+// GetServiceAddress returns the address (host:port) of any active service with the given name.
+func GetServiceAddress(serviceName string) (string, error) {
+	addresses, err := GetServiceAddresses(serviceName)
+	if err != nil {
+		return "", err
+	}
+	if len(addresses) == 0 {
+		return "", fmt.Errorf("no healthy instance of service %s found", serviceName)
+	}
+
+	return addresses[rand.Intn(len(addresses))], nil
+}
+
+// ServiceURL returns the base URL (e.g. http://host:port) of any active service with the given name.
+// The scheme is taken from the "scheme" meta data of the instance and falls back to the environment variable
+// PRODUCT_SERVICE_SCHEME and then to the default scheme set by WithDefaultScheme, which is http by default.
+func ServiceURL(serviceName string) (string, error) {
+	services, err := queryServices(serviceName, &api.QueryOptions{})
+	if err != nil {
+		return "", err
+	}
+	if len(services) == 0 {
+		return "", fmt.Errorf("no healthy instance of service %s found", serviceName)
+	}
+
+	s := services[rand.Intn(len(services))]
+	scheme := s.Service.Meta["scheme"]
+	if scheme == "" {
+		scheme = defaultConfig().scheme()
+	}
+	return fmt.Sprintf("%s://%s", scheme, entryHostPort(s)), nil
+}
+
+// scheme returns the default scheme which can be overwritten by an environment variable.
+func (c *config) scheme() string {
+	s := os.Getenv(c.envPrefix + "_SERVICE_SCHEME")
+	if len(strings.TrimSpace(s)) == 0 {
+		return c.defaultScheme
+	}
+	return strings.TrimSpace(s)
+}
+
+// GetServicesWithConsulStatuses returns all instances of the service whose aggregated check status
+// is one of the given statuses, e.g. api.HealthPassing and api.HealthWarning.
+func GetServicesWithConsulStatuses(serviceName string, statuses ...string) ([]*api.ServiceEntry, error) {
+	accepted := make(map[string]bool, len(statuses))
+	for _, status := range statuses {
+		switch status {
+		case api.HealthPassing, api.HealthWarning, api.HealthCritical, api.HealthMaint:
+			accepted[status] = true
+		default:
+			return nil, fmt.Errorf("invalid health status %s", status)
+		}
+	}
+
+	services, err := queryInstances(serviceName, false, &api.QueryOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*api.ServiceEntry, 0, len(services))
+	for _, s := range services {
+		if accepted[s.Checks.AggregatedStatus()] {
+			result = append(result, s)
+		}
+	}
+	return result, nil
+}
+
+// DatacenterErrors holds the errors of the datacenters which couldn't be queried by GetServicesAllDatacenters.
+type DatacenterErrors map[string]error
+
+func (e DatacenterErrors) Error() string {
+	datacenters := make([]string, 0, len(e))
+	for dc := range e {
+		datacenters = append(datacenters, dc)
+	}
+	sort.Strings(datacenters)
+
+	failures := make([]string, 0, len(datacenters))
+	for _, dc := range datacenters {
+		failures = append(failures, fmt.Sprintf("%s: %v", dc, e[dc]))
+	}
+	return fmt.Sprintf("searching for service failed in %d datacenters %s", len(e), strings.Join(failures, ", "))
+}
+
+// GetServicesAllDatacenters returns the healthy instances of the service in every datacenter by the name of the datacenter.
+// If some datacenters can't be queried, the results of the others are returned together with DatacenterErrors.
+func GetServicesAllDatacenters(serviceName string) (map[string][]*api.ServiceEntry, error) {
+	consul, err := newClient(defaultConfig())
+	if err != nil {
+		return nil, fmt.Errorf("could not create consul client %w", err)
+	}
+
+	datacenters, err := consul.Catalog().Datacenters()
+	if err != nil {
+		return nil, fmt.Errorf("listing datacenters failed %w", err)
+	}
+
+	results := make(map[string][]*api.ServiceEntry, len(datacenters))
+	failures := make(DatacenterErrors)
+	for _, dc := range datacenters {
+		services, err := queryServices(serviceName, &api.QueryOptions{Datacenter: dc})
+		if err != nil {
+			failures[dc] = err
+			continue
+		}
+		results[dc] = services
+	}
+	if len(failures) > 0 {
+		return results, failures
+	}
+	return results, nil
+}
+
+// queryServices returns all active services for the given name using the given query options.
+func queryServices(serviceName string, q *api.QueryOptions) ([]*api.ServiceEntry, error) {
+	return queryInstances(serviceName, true, q)
+}
+
+// GetServicesWithOptions returns all active services for the given name using the given options,
+// e.g. WithToken to query them with the token of another namespace.
+func GetServicesWithOptions(serviceName string, options ...Option) ([]*api.ServiceEntry, error) {
+	cfg := defaultConfig()
+	for _, o := range options {
+		o(cfg)
+	}
+	return queryInstancesWith(cfg, serviceName, true, &api.QueryOptions{})
+}
+
+// queryInstances returns all instances of the service, optionally only the passing ones.
+func queryInstances(serviceName string, passingOnly bool, q *api.QueryOptions) ([]*api.ServiceEntry, error) {
+	return queryInstancesWith(defaultConfig(), serviceName, passingOnly, q)
+}
+
+// queryInstancesWith is queryInstances using the given config.
+func queryInstancesWith(cfg *config, serviceName string, passingOnly bool, q *api.QueryOptions) ([]*api.ServiceEntry, error) {
+	consul, err := newClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("could not create consul client %w", err)
+	}
+	if cfg.callToken != "" {
+		if q == nil {
+			q = &api.QueryOptions{}
+		}
+		q.Token = cfg.callToken
+	}
+
+	var services []*api.ServiceEntry
+	err = retry(q.Context(), cfg.discoveryAttempts, cfg.discoveryBaseDelay, func() error {
+		services, _, err = consul.Health().Service(serviceName, "", passingOnly, q)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("searching for service failed %w", err)
+	}
+	if len(services) == 0 && cfg.onEmptyResult != nil {
+		cfg.onEmptyResult(serviceName)
+	}
+
+	return services, nil
+}
+
+// Instance is a service instance with its address, meta data, weight and aggregated health status.
+type Instance struct {
+	ID      string
+	Node    string
+	Address string
+	Port    int
+	Tags    []string
+	Meta    map[string]string
+	// Weight is the weight of the instance for its current status.
+	Weight int
+	// Status is the aggregated status of the checks of the instance, e.g. api.HealthPassing.
+	Status string
+}
+
+// GetServiceInstances returns all instances of the service with the given name regardless of their health status.
+func GetServiceInstances(serviceName string) ([]Instance, error) {
+	services, err := queryInstances(serviceName, false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	instances := make([]Instance, 0, len(services))
+	for _, s := range services {
+		instances = append(instances, newInstance(s))
+	}
+	return instances, nil
+}
+
+func newInstance(entry *api.ServiceEntry) Instance {
+	status := entry.Checks.AggregatedStatus()
+	weight := passingWeight(entry)
+	if status == api.HealthWarning {
+		weight = entry.Service.Weights.Warning
+	}
+	return Instance{
+		ID:      entry.Service.ID,
+		Node:    entry.Node.Node,
+		Address: EntryAddr(entry),
+		Port:    EntryPort(entry),
+		Tags:    EntryTags(entry),
+		Meta:    entry.Service.Meta,
+		Weight:  weight,
+		Status:  status,
+	}
+}
+
+// SRVRecord is a service instance shaped like a DNS SRV record.
+type SRVRecord struct {
+	Target   string
+	Port     int
+	Priority int
+	Weight   int
+}
+
+// GetServiceSRV returns the passing and warning instances of the service as SRV records.
+// The target is the address of the instance. The priority is 0 for passing and 1 for warning instances,
+// so clients prefer passing ones. The weight is the consul weight of the instance for its status,
+// i.e. Weights.Passing or Weights.Warning.
+func GetServiceSRV(serviceName string) ([]SRVRecord, error) {
+	services, err := GetServicesWithConsulStatuses(serviceName, api.HealthPassing, api.HealthWarning)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]SRVRecord, 0, len(services))
+	for _, s := range services {
+		instance := newInstance(s)
+		priority := 0
+		if instance.Status == api.HealthWarning {
+			priority = 1
+		}
+		records = append(records, SRVRecord{
+			Target:   instance.Address,
+			Port:     instance.Port,
+			Priority: priority,
+			Weight:   instance.Weight,
+		})
+	}
+	return records, nil
+}
+
+// EntryAddr returns the address of the service instance and falls back to the address of its node.
+func EntryAddr(entry *api.ServiceEntry) string {
+	if entry.Service.Address != "" {
+		return entry.Service.Address
+	}
+	return entry.Node.Address
+}
+
+// EntryPort returns the port of the service instance.
+func EntryPort(entry *api.ServiceEntry) int {
+	return entry.Service.Port
+}
+
+// GetServicePort returns the additional port with the given name registered using WithNamedPort.
+func GetServicePort(entry *api.ServiceEntry, name string) (int, error) {
+	key := name + "_port"
+	value, ok := entry.Service.Meta[key]
+	if !ok {
+		return 0, fmt.Errorf("the instance %s has no port %s", entry.Service.ID, name)
+	}
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q in the meta data %s", value, key)
+	}
+	return port, nil
+}
+
+// EntryTags returns the tags of the service instance.
+func EntryTags(entry *api.ServiceEntry) []string {
+	return entry.Service.Tags
+}
+
+// entryHostPort returns the host:port address of the service instance.
+func entryHostPort(entry *api.ServiceEntry) string {
+	return net.JoinHostPort(EntryAddr(entry), strconv.Itoa(EntryPort(entry)))
+}
+
+// WithExcludeUnversioned makes GetServicesMinVersion exclude the instances without a parseable version.
+func WithExcludeUnversioned() Option {
+	return func(o *config) {
+		o.excludeUnversioned = true
+	}
+}
+
+// GetServicesMinVersion returns all active services for the given name which run at least the given version,
+// e.g. to route only to upgraded instances during the rollout of a breaking change.
+// The version of an instance is taken from its "version" meta data and compared as semantic version.
+// Instances without a parseable version are included unless WithExcludeUnversioned is given.
+func GetServicesMinVersion(serviceName, minVersion string, options ...Option) ([]*api.ServiceEntry, error) {
+	min, err := parseSemver(minVersion)
+	if err != nil {
+		return nil, err
+	}
+	cfg := defaultConfig()
+	for _, o := range options {
+		o(cfg)
+	}
+
+	services, err := queryInstancesWith(cfg, serviceName, true, &api.QueryOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*api.ServiceEntry, 0, len(services))
+	for _, s := range services {
+		version, err := parseSemver(s.Service.Meta["version"])
+		if err != nil {
+			if !cfg.excludeUnversioned {
+				result = append(result, s)
+			}
+			continue
+		}
+		if version.compare(min) >= 0 {
+			result = append(result, s)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,92 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Drain gracefully removes the service with the given ID from consul.
+// It first puts the service into maintenance mode, so it doesn't receive new traffic,
+// waits the quiet period for in-flight requests to finish and finally deregisters it.
+// All calls to consul are bounded by the context.
+func Drain(ctx context.Context, serviceID string, quietPeriod time.Duration) error {
+	cfg := defaultConfig()
+	consul, err := newClient(cfg)
+	if err != nil {
+		return fmt.Errorf("could not create consul client %w", err)
+	}
+
+	err = consul.Agent().EnableServiceMaintenanceOpts(serviceID, "draining", cfg.queryOptions().WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("enabling maintenance mode failed %w", err)
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(quietPeriod):
+	}
+
+	return deregisterContext(ctx, serviceID, cfg)
+}
+
+// WithDrainOnSignal puts the service into maintenance mode when the process receives the signal,
+// so it doesn't receive new traffic while the process keeps running, e.g. to investigate it live.
+// Receiving the signal again ends the maintenance mode. The signal defaults to SIGUSR1 if nil.
+func WithDrainOnSignal(sig os.Signal) Option {
+	return func(o *config) {
+		if sig == nil {
+			sig = defaultDrainSignal
+		}
+		if sig == nil {
+			o.optionErr = errors.New("the drain signal has to be given on this platform")
+			return
+		}
+		withAfterRegister(func(registration *api.AgentServiceRegistration) error {
+			consul, err := newClient(o)
+			if err != nil {
+				return fmt.Errorf("could not create consul client %w", err)
+			}
+			serviceID := registration.ID
+			startBackground(serviceID, func(ctx context.Context) {
+				drainOnSignal(ctx, consul, serviceID, sig)
+			})
+			return nil
+		})(o)
+	}
+}
+
+// drainOnSignal toggles the maintenance mode of the service on each signal until the context is cancelled.
+func drainOnSignal(ctx context.Context, consul *api.Client, serviceID string, sig os.Signal) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, sig)
+	defer signal.Stop(signals)
+
+	draining := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+		}
+
+		var err error
+		if draining {
+			err = consul.Agent().DisableServiceMaintenance(serviceID)
+		} else {
+			err = consul.Agent().EnableServiceMaintenance(serviceID, fmt.Sprintf("draining on %v", sig))
+		}
+		if err != nil {
+			log.Printf("toggling maintenance mode failed %v", err)
+			continue
+		}
+		draining = !draining
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package common
+
+import (
+	"os"
+	"syscall"
+)
+
+var defaultDrainSignal os.Signal = syscall.SIGUSR1
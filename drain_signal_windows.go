@@ -0,0 +1,6 @@
+package common
+
+import "os"
+
+// windows has no SIGUSR1, so the signal has to be given explicitly
+var defaultDrainSignal os.Signal
@@ -0,0 +1,42 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDrainDeregistrationStopsWithContext(t *testing.T) {
+	unblock := make(chan struct{})
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/agent/service/deregister/orders-1" {
+			return
+		}
+		// the agent hangs, so only the context can stop the deregistration
+		select {
+		case <-r.Context().Done():
+		case <-unblock:
+		}
+	}))
+	defer consul.Close()
+	defer close(unblock)
+	defer setEnv(t, "CONSUL_HOST", consul.URL)()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- Drain(ctx, "orders-1", 10*time.Millisecond)
+	}()
+
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the drain to stop with the context")
+	}
+}
@@ -0,0 +1,194 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// LeaderElection elects a single leader among the instances campaigning for the same KV key.
+type LeaderElection struct {
+	key string
+
+	mu sync.Mutex
+	// cancelCampaign stops a running campaign, it is nil if there is none
+	cancelCampaign context.CancelFunc
+	consul         *api.Client
+	session        *Session
+	lost           chan struct{}
+	// stopMonitor stops watching the leadership
+	stopMonitor context.CancelFunc
+}
+
+// NewLeaderElection returns an election for the given KV key.
+func NewLeaderElection(key string) *LeaderElection {
+	return &LeaderElection{key: key}
+}
+
+// Campaign blocks until this instance becomes the leader, the context expires or StepDown is called.
+// The leadership is held by a session with the given TTL. The returned channel gets closed
+// as soon as the leadership is lost, e.g. because the session expired or StepDown was called.
+// After losing the leadership, Campaign can be called again.
+func (e *LeaderElection) Campaign(ctx context.Context, ttl time.Duration) (<-chan struct{}, error) {
+	e.mu.Lock()
+	if e.cancelCampaign != nil || e.session != nil {
+		e.mu.Unlock()
+		return nil, errors.New("already campaigning")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	e.cancelCampaign = cancel
+	e.mu.Unlock()
+
+	consul, session, err := e.acquire(ctx, ttl)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.cancelCampaign = nil
+	if err == nil && ctx.Err() != nil {
+		// StepDown was called right after acquiring the leadership
+		err = e.release(context.Background(), consul, session)
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+
+	monitorCtx, stopMonitor := context.WithCancel(context.Background())
+	e.consul = consul
+	e.session = session
+	e.lost = make(chan struct{})
+	e.stopMonitor = stopMonitor
+	go e.monitor(monitorCtx, consul, session, e.lost)
+	return e.lost, nil
+}
+
+// acquire blocks until the key is acquired by a new session or the context expires.
+func (e *LeaderElection) acquire(ctx context.Context, ttl time.Duration) (*api.Client, *Session, error) {
+	consul, err := newClient(defaultConfig())
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not create consul client %w", err)
+	}
+
+	session := NewSession()
+	// the session outlives the campaign, only its creation gets cancelled with it
+	sessionID, err := session.create(ctx, context.Background(), ttl, api.SessionBehaviorRelease)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var index uint64
+	for {
+		pair := &api.KVPair{Key: e.key, Session: sessionID}
+		acquired, _, err := consul.KV().Acquire(pair, (&api.WriteOptions{}).WithContext(ctx))
+		if err == nil && acquired {
+			return consul, session, nil
+		}
+		if err == nil {
+			// wait for a change of the key, e.g. the release by the current leader
+			var meta *api.QueryMeta
+			_, meta, err = consul.KV().Get(e.key, (&api.QueryOptions{WaitIndex: index}).WithContext(ctx))
+			if err == nil {
+				index = meta.LastIndex
+			}
+		}
+		if ctx.Err() != nil {
+			_ = session.Destroy(context.Background())
+			return nil, nil, ctx.Err()
+		}
+		if err != nil {
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+// monitor closes the lost channel as soon as the session doesn't hold the key anymore.
+func (e *LeaderElection) monitor(ctx context.Context, consul *api.Client, session *Session, lost chan struct{}) {
+	e.watchLeadership(ctx, consul, session)
+	close(lost)
+
+	// the leadership got lost without StepDown, so a new campaign can start
+	e.mu.Lock()
+	stepDown := e.session != session
+	if !stepDown {
+		e.session = nil
+	}
+	e.mu.Unlock()
+	if !stepDown {
+		_ = session.Destroy(context.Background())
+	}
+}
+
+// watchLeadership blocks until the session doesn't hold the key anymore or the context gets cancelled.
+func (e *LeaderElection) watchLeadership(ctx context.Context, consul *api.Client, session *Session) {
+	sessionID := session.ID()
+	done := session.Done()
+	var index uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-done:
+			return
+		default:
+		}
+
+		pair, meta, err := consul.KV().Get(e.key, (&api.QueryOptions{WaitIndex: index}).WithContext(ctx))
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-done:
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		if pair == nil || pair.Session != sessionID {
+			return
+		}
+		index = meta.LastIndex
+	}
+}
+
+// StepDown releases the leadership immediately, so a standby instance can take over
+// without waiting for the session TTL. The channel returned by Campaign gets closed before it returns.
+// A running campaign gets stopped and returns an error.
+func (e *LeaderElection) StepDown(ctx context.Context) error {
+	e.mu.Lock()
+	if e.cancelCampaign != nil {
+		e.cancelCampaign()
+		e.mu.Unlock()
+		return nil
+	}
+	consul, session, lost, stopMonitor := e.consul, e.session, e.lost, e.stopMonitor
+	e.session = nil
+	e.mu.Unlock()
+	if session == nil {
+		return nil
+	}
+
+	stopMonitor()
+	<-lost
+	return e.release(ctx, consul, session)
+}
+
+// release releases the key held by the session and destroys the session.
+func (e *LeaderElection) release(ctx context.Context, consul *api.Client, session *Session) error {
+	pair := &api.KVPair{Key: e.key, Session: session.ID()}
+	_, _, releaseErr := consul.KV().Release(pair, (&api.WriteOptions{}).WithContext(ctx))
+	destroyErr := session.Destroy(ctx)
+	if releaseErr != nil {
+		return fmt.Errorf("releasing leadership failed %w", releaseErr)
+	}
+	return destroyErr
+}
@@ -0,0 +1,40 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCampaignCancelsSessionCreation(t *testing.T) {
+	unblock := make(chan struct{})
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// consul doesn't answer, so only the context can stop the campaign
+		select {
+		case <-r.Context().Done():
+		case <-unblock:
+		}
+	}))
+	defer consul.Close()
+	defer close(unblock)
+	defer setEnv(t, "CONSUL_HOST", consul.URL)()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	errs := make(chan error, 1)
+	go func() {
+		_, err := NewLeaderElection("service/orders/leader").Campaign(ctx, 10*time.Second)
+		errs <- err
+	}()
+
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the campaign to stop with the context")
+	}
+}
@@ -0,0 +1,73 @@
+package common
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	// eventSizeLimit is the limit of serf for the encoded user events.
+	eventSizeLimit = 512
+	// eventEnvelopeOverhead is a conservative estimate of the bytes consul and serf add to the name and the payload
+	// of an event without filters: the event ID, the field names, the "consul:event:" prefix and the serf message.
+	// The name is contained twice, which is accounted for separately.
+	eventEnvelopeOverhead = 192
+)
+
+// FireEvent fires the user event with the given name and payload across the cluster, e.g. to invalidate caches.
+// The encoded event must not exceed 512 bytes. As the name is encoded twice and the envelope takes up to 192 bytes,
+// twice the name plus the payload must not exceed 320 bytes, e.g. 300 bytes of payload for a name of 10 bytes.
+func FireEvent(name string, payload []byte) (eventID string, err error) {
+	if size := 2*len(name) + len(payload) + eventEnvelopeOverhead; size > eventSizeLimit {
+		return "", fmt.Errorf("the event of about %d encoded bytes exceeds the limit of %d bytes", size, eventSizeLimit)
+	}
+
+	consul, err := newClient(defaultConfig())
+	if err != nil {
+		return "", fmt.Errorf("could not create consul client %w", err)
+	}
+
+	eventID, _, err = consul.Event().Fire(&api.UserEvent{Name: name, Payload: payload}, nil)
+	if err != nil {
+		return "", fmt.Errorf("firing event failed %w", err)
+	}
+	return eventID, nil
+}
+
+// WatchEvents sends the user events with the given name which are fired after the watch started.
+// The channel gets closed when the context is cancelled.
+func WatchEvents(ctx context.Context, name string) (<-chan api.UserEvent, error) {
+	consul, err := newClient(defaultConfig())
+	if err != nil {
+		return nil, fmt.Errorf("could not create consul client %w", err)
+	}
+
+	ch := make(chan api.UserEvent)
+	// the events fired before the watch started are only marked as seen
+	var seen map[string]bool
+	startWatch(ctx, func() { close(ch) }, func(ctx context.Context, q *api.QueryOptions) (uint64, error) {
+		events, meta, err := consul.Event().List(name, q)
+		if err != nil {
+			return 0, fmt.Errorf("listing events failed %w", err)
+		}
+
+		// consul only keeps the recent events, so the events which dropped out are forgotten
+		initial := seen == nil
+		current := make(map[string]bool, len(events))
+		for _, e := range events {
+			current[e.ID] = true
+			if initial || seen[e.ID] {
+				continue
+			}
+			select {
+			case ch <- *e:
+			case <-ctx.Done():
+			}
+		}
+		seen = current
+		return meta.LastIndex, nil
+	})
+	return ch, nil
+}
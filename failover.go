@@ -0,0 +1,173 @@
+package common
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WithConsulAddresses uses a pool of consul agents. The client connects to the first reachable one
+// and fails over to the next address as soon as the current agent is unreachable.
+// Without this option and WithAgentAddress, the comma separated addresses of the environment variable CONSUL_HOSTS
+// are used if set. It takes precedence over WithAgentAddress, CONSUL_HOSTS and CONSUL_HOST.
+func WithConsulAddresses(addrs ...string) Option {
+	return func(o *config) {
+		if len(addrs) == 0 {
+			o.optionErr = errors.New("at least one consul address has to be given")
+			return
+		}
+		o.consulAddressPool = addrs
+	}
+}
+
+// consulAddresses returns the configured pool of consul agents.
+// CONSUL_HOSTS is only used if no address is set explicitly.
+func (c *config) consulAddresses() []string {
+	if len(c.consulAddressPool) > 0 {
+		return c.consulAddressPool
+	}
+	if c.agentAddress != "" {
+		return nil
+	}
+	var addrs []string
+	for _, addr := range strings.Split(os.Getenv("CONSUL_HOSTS"), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// failoverTransport sends the requests to the first reachable address of the pool.
+type failoverTransport struct {
+	addrs []string
+	base  http.RoundTripper
+
+	mu      sync.Mutex
+	current int
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	start := t.current
+	t.mu.Unlock()
+
+	var err error
+	for i := range t.addrs {
+		index := (start + i) % len(t.addrs)
+		attempt := req.Clone(req.Context())
+		scheme, host := splitAddress(t.addrs[index])
+		if scheme != "" {
+			attempt.URL.Scheme = scheme
+		}
+		attempt.URL.Host = host
+		attempt.Host = host
+		if i > 0 && req.Body != nil && req.Body != http.NoBody {
+			// the body got consumed by the previous attempt
+			if req.GetBody == nil {
+				return nil, err
+			}
+			attempt.Body, err = req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		var resp *http.Response
+		resp, err = t.base.RoundTrip(attempt)
+		var opErr *net.OpError
+		if err == nil || !errors.As(err, &opErr) || opErr.Op != "dial" {
+			if err == nil {
+				t.mu.Lock()
+				t.current = index
+				t.mu.Unlock()
+			}
+			return resp, err
+		}
+	}
+	return nil, err
+}
+
+// splitAddress splits an address like https://consul:8501 into its scheme and host.
+func splitAddress(addr string) (scheme, host string) {
+	if i := strings.Index(addr, "://"); i >= 0 {
+		return addr[:i], addr[i+3:]
+	}
+	return "", addr
+}
+
+// WithAPIRetry retries failed requests to consul up to maxRetries times, including connection errors
+// and the status codes 500, 502, 503 and 504. The wait between the retries grows exponentially from waitMin
+// up to waitMax. Requests whose body can't be sent again are not retried.
+// The consul api client has no retry settings of its own up to v1.12 which this package uses,
+// so the retries are done by the transport of its http client.
+func WithAPIRetry(maxRetries int, waitMin, waitMax time.Duration) Option {
+	return func(o *config) {
+		if maxRetries < 0 || waitMin < 0 || waitMax < waitMin {
+			o.optionErr = errors.New("invalid api retry settings")
+			return
+		}
+		o.apiRetries = maxRetries
+		o.apiRetryWaitMin = waitMin
+		o.apiRetryWaitMax = waitMax
+	}
+}
+
+// retryTransport retries failed requests to consul.
+type retryTransport struct {
+	retries int
+	waitMin time.Duration
+	waitMax time.Duration
+	base    http.RoundTripper
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	hasBody := req.Body != nil && req.Body != http.NoBody
+	for attempt := 0; ; attempt++ {
+		attemptReq := req
+		if attempt > 0 && hasBody {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptReq = req.Clone(req.Context())
+			attemptReq.Body = body
+		}
+
+		resp, err := t.base.RoundTrip(attemptReq)
+		if attempt >= t.retries || (hasBody && req.GetBody == nil) || !retryable(resp, err) {
+			return resp, err
+		}
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+
+		wait := t.waitMin << uint(attempt)
+		if wait > t.waitMax || wait <= 0 {
+			wait = t.waitMax
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// retryable reports whether the request failed transiently.
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		var netErr net.Error
+		return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || strings.Contains(err.Error(), "connection reset")
+	}
+	switch resp.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
@@ -2,4 +2,9 @@ module github.com/scayle/common-go
 
 go 1.15
 
-require github.com/hashicorp/consul/api v1.7.0
+require (
+	github.com/hashicorp/consul/api v1.12.0
+	github.com/hashicorp/consul/sdk v0.8.0
+	github.com/hashicorp/serf v0.9.6
+	google.golang.org/grpc v1.34.0
+)
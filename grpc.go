@@ -0,0 +1,93 @@
+package common
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/consul/api"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/resolver"
+)
+
+// GRPCScheme is the scheme of the gRPC resolver which resolves service names using consul.
+const GRPCScheme = "consul"
+
+// DialGRPC creates a gRPC client connection to the service with the given name.
+// The connection is balanced (round robin) over all healthy instances and gets updated
+// whenever instances come and go.
+// The connection is insecure unless transport credentials are passed with the dial options.
+func DialGRPC(ctx context.Context, serviceName string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	services, err := queryServices(serviceName, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if len(services) == 0 {
+		return nil, fmt.Errorf("no healthy instance of service %s found", serviceName)
+	}
+
+	opts = append([]grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithResolvers(GRPCResolver()),
+		grpc.WithDefaultServiceConfig(`{"loadBalancingPolicy":"round_robin"}`),
+	}, opts...)
+
+	return grpc.DialContext(ctx, fmt.Sprintf("%s:///%s", GRPCScheme, serviceName), opts...)
+}
+
+// GRPCResolver returns a gRPC resolver builder for targets like consul:///service-name.
+// It can be registered globally using resolver.Register or passed with grpc.WithResolvers.
+func GRPCResolver() resolver.Builder {
+	return grpcResolverBuilder{}
+}
+
+type grpcResolverBuilder struct{}
+
+func (grpcResolverBuilder) Scheme() string {
+	return GRPCScheme
+}
+
+func (grpcResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	ch, w, err := WatchService(context.Background(), target.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		errs := w.Errors()
+		for {
+			select {
+			case services, ok := <-ch:
+				if !ok {
+					return
+				}
+				addresses := make([]resolver.Address, 0, len(services))
+				for _, s := range services {
+					addresses = append(addresses, resolver.Address{
+						Addr: entryHostPort(s),
+					})
+				}
+				cc.UpdateState(resolver.State{Addresses: addresses})
+			case err, ok := <-errs:
+				if !ok {
+					errs = nil
+					continue
+				}
+				cc.ReportError(err)
+			}
+		}
+	}()
+
+	return &grpcResolver{watch: w}, nil
+}
+
+type grpcResolver struct {
+	watch *Watch
+}
+
+// ResolveNow is a no-op as the resolver permanently watches consul.
+func (*grpcResolver) ResolveNow(resolver.ResolveNowOptions) {}
+
+func (r *grpcResolver) Close() {
+	r.watch.Stop()
+}
@@ -0,0 +1,514 @@
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// HealthCheckConfig holds settings for the consul checks of the service.
+// Zero values keep the defaults of the checks.
+type HealthCheckConfig struct {
+	Interval time.Duration
+	Timeout  time.Duration
+	// Method and Header are used for the requests of HTTP checks.
+	Method string
+	Header map[string][]string
+	// SuccessBeforePassing and FailuresBeforeCritical define how many consecutive results
+	// are needed to change the status of a check.
+	SuccessBeforePassing   int
+	FailuresBeforeCritical int
+	// DeregisterCriticalServiceAfter deregisters the service if the check is critical for that long.
+	DeregisterCriticalServiceAfter time.Duration
+	// Notes is a static description of the check shown in the consul UI.
+	// The dynamic output of the HTTP checks contains the errors of the failed health checkers.
+	Notes string
+	// TLSServerName is the name the certificate of HTTPS checks is verified against instead of the host.
+	// Setting it enables the verification which WithHTTPSHealthCheck skips by default.
+	TLSServerName string
+	// Host and Port move the target of HTTP, TCP, gRPC and H2PING checks away from the advertised service address,
+	// e.g. to the admin interface of a sidecar. Path replaces the path of HTTP checks.
+	// They only change where consul probes, the health webserver of WithHTTPHealthCheck keeps its port.
+	Host string
+	Port int
+	Path string
+}
+
+// apply sets the non-zero settings on the check.
+// Interval and Timeout are skipped for TTL checks, which consul rejects with an interval.
+func (c HealthCheckConfig) apply(check *api.AgentServiceCheck) {
+	if c.Interval > 0 && check.TTL == "" {
+		check.Interval = c.Interval.String()
+	}
+	if c.Timeout > 0 && check.TTL == "" {
+		check.Timeout = c.Timeout.String()
+	}
+	if c.Method != "" {
+		check.Method = c.Method
+	}
+	if c.Header != nil {
+		check.Header = c.Header
+	}
+	if c.SuccessBeforePassing > 0 {
+		check.SuccessBeforePassing = c.SuccessBeforePassing
+	}
+	if c.FailuresBeforeCritical > 0 {
+		check.FailuresBeforeCritical = c.FailuresBeforeCritical
+	}
+	if c.DeregisterCriticalServiceAfter > 0 {
+		check.DeregisterCriticalServiceAfter = c.DeregisterCriticalServiceAfter.String()
+	}
+	if c.Notes != "" {
+		check.Notes = c.Notes
+	}
+	if c.TLSServerName != "" && strings.HasPrefix(check.HTTP, "https://") {
+		check.TLSServerName = c.TLSServerName
+		check.TLSSkipVerify = false
+	}
+	c.retarget(check)
+}
+
+// retarget replaces the host, port and path of the check target with the non-zero settings.
+func (c HealthCheckConfig) retarget(check *api.AgentServiceCheck) {
+	if c.Host == "" && c.Port == 0 && c.Path == "" {
+		return
+	}
+
+	switch {
+	case check.HTTP != "":
+		u, err := url.Parse(check.HTTP)
+		if err != nil {
+			return
+		}
+		u.Host = c.hostPort(u.Host)
+		if c.Path != "" {
+			u.Path = c.Path
+		}
+		check.HTTP = u.String()
+	case check.TCP != "":
+		check.TCP = c.hostPort(check.TCP)
+	case check.GRPC != "":
+		// keep the name of the checked service, e.g. host:port/service
+		parts := strings.SplitN(check.GRPC, "/", 2)
+		parts[0] = c.hostPort(parts[0])
+		check.GRPC = strings.Join(parts, "/")
+	case check.H2PING != "":
+		check.H2PING = c.hostPort(check.H2PING)
+	}
+}
+
+// hostPort replaces the host and the port of the address with the non-zero settings.
+func (c HealthCheckConfig) hostPort(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		// the address has no port
+		host, port = strings.Trim(address, "[]"), ""
+	}
+	if c.Host != "" {
+		host = c.Host
+	}
+	if c.Port > 0 {
+		port = strconv.Itoa(c.Port)
+	}
+	if port != "" {
+		return net.JoinHostPort(host, port)
+	}
+	if strings.Contains(host, ":") {
+		return "[" + host + "]"
+	}
+	return host
+}
+
+// WithHealthCheckConfig applies the settings to all checks of the service.
+// The settings passed to a single health check option, e.g. WithTCPHealthCheck, take precedence for that check.
+// OutputMaxSize and redirect handling of the checks can't be set as the consul api client doesn't support them.
+// The maximum output size can only be raised for all checks of an agent using check_output_max_size
+// in the agent config, the default is 4096 bytes.
+func WithHealthCheckConfig(healthCheck HealthCheckConfig) Option {
+	return func(o *config) {
+		o.healthCheck = healthCheck
+	}
+}
+
+// HealthChecker checks a part of the service and returns an error if it isn't healthy.
+type HealthChecker func() error
+
+var (
+	healthCheckersMu sync.RWMutex
+	healthCheckers   = make(map[string]HealthChecker)
+)
+
+// RegisterHealthChecker adds a checker to the health webserver. The webserver answers with
+// 503 Service Unavailable and the errors in the body as soon as any checker fails.
+// Registering a checker with an already used name replaces the previous one.
+func RegisterHealthChecker(name string, checker HealthChecker) {
+	healthCheckersMu.Lock()
+	defer healthCheckersMu.Unlock()
+	healthCheckers[name] = checker
+}
+
+// HealthCheckResult is the result of the last run of a health checker.
+type HealthCheckResult struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Duration string `json:"duration,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// LastRun is nil as long as the checker didn't run
+	LastRun *time.Time `json:"lastRun,omitempty"`
+}
+
+var (
+	healthResultsMu sync.Mutex
+	healthResults   = make(map[string]HealthCheckResult)
+)
+
+// runHealthCheckers runs all registered checkers and returns the failures sorted by name.
+func runHealthCheckers() []string {
+	healthCheckersMu.RLock()
+	defer healthCheckersMu.RUnlock()
+
+	var failures []string
+	for name, checker := range healthCheckers {
+		start := time.Now()
+		err := checker()
+		result := HealthCheckResult{Name: name, Status: api.HealthPassing, Duration: time.Since(start).String(), LastRun: &start}
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", name, err))
+			result.Status, result.Error = api.HealthCritical, err.Error()
+		}
+		healthResultsMu.Lock()
+		healthResults[name] = result
+		healthResultsMu.Unlock()
+	}
+	sort.Strings(failures)
+	return failures
+}
+
+// healthCheckResults returns the last results of all registered checkers sorted by name.
+// Checkers which didn't run yet have the status unknown.
+func healthCheckResults() []HealthCheckResult {
+	healthCheckersMu.RLock()
+	defer healthCheckersMu.RUnlock()
+	healthResultsMu.Lock()
+	defer healthResultsMu.Unlock()
+
+	results := make([]HealthCheckResult, 0, len(healthCheckers))
+	for name := range healthCheckers {
+		result, ok := healthResults[name]
+		if !ok {
+			result = HealthCheckResult{Name: name, Status: "unknown"}
+		}
+		results = append(results, result)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Name < results[j].Name })
+	return results
+}
+
+// healthDetailHandler answers with the last results of the health checkers as JSON.
+func healthDetailHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(healthCheckResults()); err != nil {
+		panic(err)
+	}
+}
+
+// WithHealthDetailPath sets the path the health webserver serves the last results of the health checkers
+// as JSON on, including their status, duration and error. The default is /health/detail.
+func WithHealthDetailPath(path string) Option {
+	return func(o *config) {
+		o.healthDetailPath = path
+	}
+}
+
+// detailPath returns the path of the health detail endpoint.
+func (c *config) detailPath() string {
+	if c.healthDetailPath == "" {
+		return "/health/detail"
+	}
+	return c.healthDetailPath
+}
+
+// DependsOnService returns a checker which fails if fewer than minInstances instances
+// of the service with the given name are passing in consul.
+// It is meant to be added to the health webserver using RegisterHealthChecker.
+func DependsOnService(serviceName string, minInstances int) HealthChecker {
+	return func() error {
+		services, err := queryServices(serviceName, nil)
+		if err != nil {
+			return err
+		}
+		if len(services) < minInstances {
+			return fmt.Errorf("dependency %s has %d of %d required healthy instances", serviceName, len(services), minInstances)
+		}
+		return nil
+	}
+}
+
+// MaxGoroutines returns a checker which fails while more than n goroutines are running,
+// so an overloaded instance sheds traffic until it recovers.
+func MaxGoroutines(n int) HealthChecker {
+	return func() error {
+		if count := runtime.NumGoroutine(); count > n {
+			return fmt.Errorf("%d goroutines exceed the limit of %d", count, n)
+		}
+		return nil
+	}
+}
+
+// MaxHeapBytes returns a checker which fails while the allocated heap exceeds n bytes.
+func MaxHeapBytes(n uint64) HealthChecker {
+	return func() error {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		if stats.HeapAlloc > n {
+			return fmt.Errorf("%d heap bytes exceed the limit of %d", stats.HeapAlloc, n)
+		}
+		return nil
+	}
+}
+
+// heartbeat updates the TTL check with the result of the health checkers until the context is cancelled.
+func heartbeat(ctx context.Context, consul *api.Client, checkID string, ttl time.Duration) {
+	atomic.AddInt64(&activeHeartbeats, 1)
+	defer atomic.AddInt64(&activeHeartbeats, -1)
+
+	interval := ttl / 2
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		status, output := api.HealthPassing, "I am alive!"
+		if failures := runHealthCheckers(); len(failures) > 0 {
+			status, output = api.HealthCritical, strings.Join(failures, "\n")
+		}
+		if err := consul.Agent().UpdateTTL(checkID, output, status); err != nil {
+			log.Printf("updating ttl check %s failed %v", checkID, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// BindTTLToGauge updates the TTL check with the given ID in the background every interval based on the gauge.
+// The check is critical if the value reaches critAt, warning if it reaches warnAt and passing otherwise.
+// The output of the check contains the value. Cancelling the context stops the updates and leaves the last status.
+func BindTTLToGauge(ctx context.Context, checkID string, interval time.Duration, read func() (value, warnAt, critAt float64)) error {
+	if interval <= 0 {
+		return errors.New("the interval has to be positive")
+	}
+	consul, err := newClient(defaultConfig())
+	if err != nil {
+		return fmt.Errorf("could not create consul client %w", err)
+	}
+
+	atomic.AddInt64(&activeHeartbeats, 1)
+	go func() {
+		defer atomic.AddInt64(&activeHeartbeats, -1)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			value, warnAt, critAt := read()
+			status := api.HealthPassing
+			switch {
+			case value >= critAt:
+				status = api.HealthCritical
+			case value >= warnAt:
+				status = api.HealthWarning
+			}
+			output := fmt.Sprintf("value %g (warning at %g, critical at %g)", value, warnAt, critAt)
+			if err := consul.Agent().UpdateTTLOpts(checkID, output, status, (&api.QueryOptions{}).WithContext(ctx)); err != nil && ctx.Err() == nil {
+				log.Printf("updating ttl check %s failed %v", checkID, err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+var (
+	healthServersMu sync.Mutex
+	healthServers   = make(map[int]*http.Server)
+	healthMuxes     = make(map[*http.ServeMux]bool)
+)
+
+var (
+	healthResponseMu sync.RWMutex
+	healthResponse   func() (int, string)
+)
+
+// healthHandler answers the health checks of consul.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	if failures := runHealthCheckers(); len(failures) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, err := fmt.Fprint(w, strings.Join(failures, "\n"))
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	healthResponseMu.RLock()
+	response := healthResponse
+	healthResponseMu.RUnlock()
+	if response != nil {
+		statusCode, body := response()
+		w.WriteHeader(statusCode)
+		_, err := fmt.Fprint(w, body)
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	_, err := fmt.Fprintf(w, `I am alive!`)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// WithHealthResponse sets the status code and the body the health webserver answers with while healthy.
+// The default is 200 OK with the body "I am alive!".
+func WithHealthResponse(statusCode int, body string) Option {
+	return WithHealthResponseFunc(func() (int, string) {
+		return statusCode, body
+	})
+}
+
+// WithHealthResponseFunc sets a function deciding per request about the status code and the body
+// the health webserver answers with while healthy.
+func WithHealthResponseFunc(response func() (int, string)) Option {
+	return withBeforeRegister(func(registration *api.AgentServiceRegistration) error {
+		healthResponseMu.Lock()
+		defer healthResponseMu.Unlock()
+		healthResponse = response
+		return nil
+	})
+}
+
+// handleHealth adds the health handlers to the mux unless they were already added.
+func handleHealth(mux *http.ServeMux, detailPath string) {
+	healthServersMu.Lock()
+	defer healthServersMu.Unlock()
+	handleHealthLocked(mux, detailPath)
+}
+
+func handleHealthLocked(mux *http.ServeMux, detailPath string) {
+	if healthMuxes[mux] {
+		return
+	}
+	healthMuxes[mux] = true
+	mux.HandleFunc("/healthcheck", healthHandler)
+	mux.HandleFunc(detailPath, healthDetailHandler)
+}
+
+// startHealthServer starts the health webserver on the given port unless it is already running.
+// The server uses TLS if a tls config is given.
+// The port gets bound before returning, so errors like an already used port are returned.
+// Later errors of the server are passed to the handler of WithHealthServerErrorHandler or logged.
+func startHealthServer(port int, tlsConfig *tls.Config, cfg *config) error {
+	healthServersMu.Lock()
+	defer healthServersMu.Unlock()
+	if healthServers[port] != nil {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		// e.g. a previous incarnation of the service still serves the health checks during a fast restart
+		if servesHealth(port, tlsConfig != nil) {
+			log.Printf("healthcheck webserver already running on port %d, reusing it", port)
+			return nil
+		}
+		return fmt.Errorf("starting healthcheck webserver failed, port %d is used by something else %w", port, err)
+	}
+
+	server := &http.Server{}
+	if tlsConfig == nil {
+		handleHealthLocked(http.DefaultServeMux, cfg.detailPath())
+	} else {
+		mux := http.NewServeMux()
+		handleHealthLocked(mux, cfg.detailPath())
+		server.Handler = mux
+		server.TLSConfig = tlsConfig
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	healthServers[port] = server
+
+	go func() {
+		err := server.Serve(listener)
+		if errors.Is(err, http.ErrServerClosed) {
+			return
+		}
+		if cfg.healthServerErrors != nil {
+			cfg.healthServerErrors(err)
+			return
+		}
+		log.Printf("healthcheck webserver failed %v", err)
+	}()
+	return nil
+}
+
+// servesHealth reports whether a health webserver of this package is answering on the local port.
+func servesHealth(port int, useTLS bool) bool {
+	scheme := "http"
+	client := &http.Client{Timeout: 2 * time.Second}
+	if useTLS {
+		scheme = "https"
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+
+	resp, err := client.Get(fmt.Sprintf("%s://localhost:%d/healthcheck", scheme, port))
+	if err != nil {
+		return false
+	}
+	_ = resp.Body.Close()
+	// failing health checkers answer with 503
+	return resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusServiceUnavailable
+}
+
+// ShutdownHealthServers gracefully shuts down all running health webservers.
+// They get started again by the next registration using them.
+func ShutdownHealthServers(ctx context.Context) error {
+	healthServersMu.Lock()
+	defer healthServersMu.Unlock()
+
+	var errs []string
+	for port, server := range healthServers {
+		if err := server.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Sprintf("port %d: %v", port, err))
+		}
+		delete(healthServers, port)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("shutting down healthcheck webservers failed %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
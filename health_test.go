@@ -0,0 +1,168 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestHealthCheckConfigRetarget(t *testing.T) {
+	tests := []struct {
+		name   string
+		config HealthCheckConfig
+		check  api.AgentServiceCheck
+		want   api.AgentServiceCheck
+	}{
+		{
+			name:   "http host, port and path",
+			config: HealthCheckConfig{Host: "127.0.0.1", Port: 9000, Path: "/admin/health"},
+			check:  api.AgentServiceCheck{HTTP: "http://orders:8101/healthcheck"},
+			want:   api.AgentServiceCheck{HTTP: "http://127.0.0.1:9000/admin/health"},
+		},
+		{
+			name:   "http path only",
+			config: HealthCheckConfig{Path: "/ready"},
+			check:  api.AgentServiceCheck{HTTP: "https://orders:8101/healthcheck"},
+			want:   api.AgentServiceCheck{HTTP: "https://orders:8101/ready"},
+		},
+		{
+			name:   "http ipv6 host",
+			config: HealthCheckConfig{Host: "::1"},
+			check:  api.AgentServiceCheck{HTTP: "http://orders:8101/healthcheck"},
+			want:   api.AgentServiceCheck{HTTP: "http://[::1]:8101/healthcheck"},
+		},
+		{
+			name:   "http ipv6 without port",
+			config: HealthCheckConfig{Path: "/ready"},
+			check:  api.AgentServiceCheck{HTTP: "http://[fe80::1]/healthcheck"},
+			want:   api.AgentServiceCheck{HTTP: "http://[fe80::1]/ready"},
+		},
+		{
+			name:   "tcp port only",
+			config: HealthCheckConfig{Port: 9000},
+			check:  api.AgentServiceCheck{TCP: "orders:8100"},
+			want:   api.AgentServiceCheck{TCP: "orders:9000"},
+		},
+		{
+			name:   "tcp ipv6 port",
+			config: HealthCheckConfig{Port: 2},
+			check:  api.AgentServiceCheck{TCP: "[::1]:1"},
+			want:   api.AgentServiceCheck{TCP: "[::1]:2"},
+		},
+		{
+			name:   "tcp ignores path",
+			config: HealthCheckConfig{Path: "/ready"},
+			check:  api.AgentServiceCheck{TCP: "orders:8100"},
+			want:   api.AgentServiceCheck{TCP: "orders:8100"},
+		},
+		{
+			name:   "grpc keeps the service",
+			config: HealthCheckConfig{Host: "127.0.0.1", Port: 9000},
+			check:  api.AgentServiceCheck{GRPC: "orders:8100/orders.v1.Orders"},
+			want:   api.AgentServiceCheck{GRPC: "127.0.0.1:9000/orders.v1.Orders"},
+		},
+		{
+			name:   "grpc without service",
+			config: HealthCheckConfig{Host: "::1"},
+			check:  api.AgentServiceCheck{GRPC: "orders:8100"},
+			want:   api.AgentServiceCheck{GRPC: "[::1]:8100"},
+		},
+		{
+			name:   "h2ping",
+			config: HealthCheckConfig{Host: "sidecar"},
+			check:  api.AgentServiceCheck{H2PING: "orders:8100"},
+			want:   api.AgentServiceCheck{H2PING: "sidecar:8100"},
+		},
+		{
+			name:   "ttl unchanged",
+			config: HealthCheckConfig{Host: "sidecar", Port: 9000},
+			check:  api.AgentServiceCheck{TTL: "10s"},
+			want:   api.AgentServiceCheck{TTL: "10s"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			check := tt.check
+			tt.config.retarget(&check)
+			if check.HTTP != tt.want.HTTP || check.TCP != tt.want.TCP || check.GRPC != tt.want.GRPC ||
+				check.H2PING != tt.want.H2PING || check.TTL != tt.want.TTL {
+				t.Errorf("expected %+v, got %+v", tt.want, check)
+			}
+		})
+	}
+}
+
+func TestHealthCheckConfigHostPort(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  HealthCheckConfig
+		address string
+		want    string
+	}{
+		{name: "unchanged", address: "orders:8100", want: "orders:8100"},
+		{name: "host", config: HealthCheckConfig{Host: "10.0.0.1"}, address: "orders:8100", want: "10.0.0.1:8100"},
+		{name: "port", config: HealthCheckConfig{Port: 9000}, address: "orders:8100", want: "orders:9000"},
+		{name: "port added", config: HealthCheckConfig{Port: 9000}, address: "orders", want: "orders:9000"},
+		{name: "ipv6 host", config: HealthCheckConfig{Host: "::1"}, address: "orders:8100", want: "[::1]:8100"},
+		{name: "ipv6 without port", config: HealthCheckConfig{Host: "::1"}, address: "orders", want: "[::1]"},
+		{name: "ipv6 port added", config: HealthCheckConfig{Port: 9000}, address: "[::1]", want: "[::1]:9000"},
+		{name: "ipv6 kept", config: HealthCheckConfig{Port: 9000}, address: "[fe80::1]:8100", want: "[fe80::1]:9000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.hostPort(tt.address); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestHealthDetailHandlerLastRun(t *testing.T) {
+	RegisterHealthChecker("test-database", func() error { return errors.New("connection refused") })
+	defer func() {
+		healthCheckersMu.Lock()
+		delete(healthCheckers, "test-database")
+		healthCheckersMu.Unlock()
+		healthResultsMu.Lock()
+		delete(healthResults, "test-database")
+		healthResultsMu.Unlock()
+	}()
+
+	detail := func() map[string]interface{} {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		healthDetailHandler(recorder, httptest.NewRequest(http.MethodGet, "/health/detail", nil))
+		var results []map[string]interface{}
+		if err := json.NewDecoder(recorder.Body).Decode(&results); err != nil {
+			t.Fatal(err)
+		}
+		for _, result := range results {
+			if result["name"] == "test-database" {
+				return result
+			}
+		}
+		t.Fatalf("expected a result of the checker, got %v", results)
+		return nil
+	}
+
+	result := detail()
+	if result["status"] != "unknown" {
+		t.Errorf("expected the status unknown before the first run, got %v", result["status"])
+	}
+	if lastRun, ok := result["lastRun"]; ok {
+		t.Errorf("expected no last run before the first run, got %v", lastRun)
+	}
+
+	runHealthCheckers()
+	result = detail()
+	if result["status"] != api.HealthCritical || result["error"] != "connection refused" {
+		t.Errorf("expected the critical status with the error, got %v", result)
+	}
+	if lastRun, ok := result["lastRun"].(string); !ok || lastRun == "" {
+		t.Errorf("expected the last run after the first run, got %v", result["lastRun"])
+	}
+}
@@ -0,0 +1,139 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// KVTxn executes the given KV operations atomically.
+// It returns whether the transaction succeeded and the results of the single operations.
+// A failed transaction, e.g. because of a failed check-and-set, is not reported as error
+// but by the returned boolean and the errors within the response.
+func KVTxn(ctx context.Context, ops api.KVTxnOps) (bool, *api.KVTxnResponse, error) {
+	consul, err := newClient(defaultConfig())
+	if err != nil {
+		return false, nil, fmt.Errorf("could not create consul client %w", err)
+	}
+
+	ok, response, _, err := consul.KV().Txn(ops, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return false, nil, fmt.Errorf("executing kv transaction failed %w", err)
+	}
+
+	return ok, response, nil
+}
+
+// GetKVWithIndex returns the value of the KV entry with the given key and its modify index for CASKV.
+// A missing entry is returned as nil value with the index 0.
+func GetKVWithIndex(ctx context.Context, key string) (value []byte, modifyIndex uint64, err error) {
+	consul, err := newClient(defaultConfig())
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not create consul client %w", err)
+	}
+
+	pair, _, err := consul.KV().Get(key, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading kv entry failed %w", err)
+	}
+	if pair == nil {
+		return nil, 0, nil
+	}
+	return pair.Value, pair.ModifyIndex, nil
+}
+
+// CASKV writes the KV entry only if it wasn't modified since the given modify index of GetKVWithIndex.
+// The index 0 writes the entry only if it doesn't exist yet. It returns false if the entry was modified
+// in between, so the caller can read it again and retry.
+func CASKV(ctx context.Context, key string, value []byte, modifyIndex uint64) (bool, error) {
+	consul, err := newClient(defaultConfig())
+	if err != nil {
+		return false, fmt.Errorf("could not create consul client %w", err)
+	}
+
+	ok, _, err := consul.KV().CAS(&api.KVPair{Key: key, Value: value, ModifyIndex: modifyIndex}, (&api.WriteOptions{}).WithContext(ctx))
+	if err != nil {
+		return false, fmt.Errorf("writing kv entry failed %w", err)
+	}
+	return ok, nil
+}
+
+// maxTxnOps is the maximum number of operations consul accepts within a transaction.
+const maxTxnOps = 64
+
+// PutKVTree writes the values atomically as the KV entries "<prefix>/<key>".
+// As consul limits transactions to 64 operations, at most 64 values can be written at once.
+func PutKVTree(ctx context.Context, prefix string, values map[string][]byte) error {
+	if len(values) > maxTxnOps {
+		return fmt.Errorf("at most %d kv entries can be written at once, got %d", maxTxnOps, len(values))
+	}
+
+	prefix = strings.TrimSuffix(prefix, "/")
+	ops := make(api.KVTxnOps, 0, len(values))
+	for key, value := range values {
+		ops = append(ops, &api.KVTxnOp{Verb: api.KVSet, Key: prefix + "/" + key, Value: value})
+	}
+
+	ok, response, err := KVTxn(ctx, ops)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		var errs []string
+		for _, e := range response.Errors {
+			errs = append(errs, e.What)
+		}
+		return fmt.Errorf("writing kv tree failed %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// GetKVTree returns the values of all KV entries below the prefix by their keys without the prefix.
+func GetKVTree(ctx context.Context, prefix string) (map[string][]byte, error) {
+	consul, err := newClient(defaultConfig())
+	if err != nil {
+		return nil, fmt.Errorf("could not create consul client %w", err)
+	}
+
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+	pairs, _, err := consul.KV().List(prefix, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("reading kv tree failed %w", err)
+	}
+
+	values := make(map[string][]byte, len(pairs))
+	for _, pair := range pairs {
+		values[strings.TrimPrefix(pair.Key, prefix)] = pair.Value
+	}
+	return values, nil
+}
+
+// WaitForKV blocks until the value of the KV entry with the given key satisfies the predicate
+// and returns that value. The predicate gets nil for a missing entry.
+func WaitForKV(ctx context.Context, key string, predicate func([]byte) bool) ([]byte, error) {
+	ch, w, err := WatchKV(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer w.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case pair, ok := <-ch:
+			if !ok {
+				return nil, ctx.Err()
+			}
+			var value []byte
+			if pair != nil {
+				value = pair.Value
+			}
+			if predicate(value) {
+				return value, nil
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// LifecycleManager coordinates the graceful termination of a registered service.
+type LifecycleManager struct {
+	registration *api.AgentServiceRegistration
+	quietPeriod  time.Duration
+	cfg          *config
+}
+
+// NewLifecycleManager returns a manager for the registration and the health webserver started with it.
+// The options should match the ones used for the registration.
+// The quiet period is the time between marking the service as not ready and the deregistration,
+// which should be long enough for the clients to pick up the change and for in-flight requests to finish.
+func NewLifecycleManager(registration *api.AgentServiceRegistration, quietPeriod time.Duration, options ...Option) *LifecycleManager {
+	cfg := defaultConfig()
+	for _, o := range options {
+		o(cfg)
+	}
+	return &LifecycleManager{registration: registration, quietPeriod: quietPeriod, cfg: cfg}
+}
+
+// Shutdown terminates the service in order:
+// it puts the service into maintenance mode, so it is not ready regardless of the kind of its checks,
+// waits the quiet period, deregisters the service from consul and finally shuts down the health webservers.
+// Services registered in the catalog have no agent supporting the maintenance mode, they are deregistered
+// after the quiet period without being marked before.
+// All steps are bounded by the context, if it expires the remaining steps are skipped.
+func (m *LifecycleManager) Shutdown(ctx context.Context) error {
+	serviceID := m.registration.ID
+	if !m.cfg.catalogRegistration && !catalogRegistered(serviceID) {
+		consul, err := newClient(m.cfg)
+		if err != nil {
+			return fmt.Errorf("could not create consul client %w", err)
+		}
+		err = consul.Agent().EnableServiceMaintenanceOpts(serviceID, "shutting down", m.cfg.queryOptions().WithContext(ctx))
+		if err != nil {
+			return fmt.Errorf("enabling maintenance mode failed %w", err)
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for the quiet period failed %w", ctx.Err())
+	case <-time.After(m.quietPeriod):
+	}
+
+	if err := deregisterContext(ctx, serviceID, m.cfg); err != nil {
+		return err
+	}
+
+	return ShutdownHealthServers(ctx)
+}
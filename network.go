@@ -1,8 +1,14 @@
 package common
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"os"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
 )
 
 func Hostname() string {
@@ -12,3 +18,131 @@ func Hostname() string {
 	}
 	return hostname
 }
+
+// defaultOutboundTarget is the public address OutboundIP determines the route to.
+const defaultOutboundTarget = "8.8.8.8:80"
+
+// OutboundIP returns the local IP used for outgoing connections.
+// No packets are sent to determine it.
+func OutboundIP() (net.IP, error) {
+	return outboundIP(defaultOutboundTarget)
+}
+
+// OutboundIPVia returns the local IP used for outgoing connections to the given address (host:port),
+// e.g. an internal address in air-gapped environments where the public default isn't routable.
+// If there is no route to the address, it falls back to the default of OutboundIP.
+func OutboundIPVia(addr string) (net.IP, error) {
+	ip, err := outboundIP(addr)
+	if err == nil || addr == defaultOutboundTarget {
+		return ip, err
+	}
+	if fallback, fallbackErr := outboundIP(defaultOutboundTarget); fallbackErr == nil {
+		return fallback, nil
+	}
+	return nil, err
+}
+
+func outboundIP(addr string) (net.IP, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("detecting outbound ip failed %w", err)
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// AddressSource returns an address the service can be registered with.
+type AddressSource func() (string, error)
+
+// AddressFromEnv reads the address from the given environment variable, e.g. POD_IP.
+func AddressFromEnv(name string) AddressSource {
+	return func() (string, error) {
+		address := strings.TrimSpace(os.Getenv(name))
+		if address == "" {
+			return "", fmt.Errorf("the environment variable %s is not set", name)
+		}
+		return address, nil
+	}
+}
+
+// AddressOutboundIP uses the local IP for outgoing connections (see OutboundIP).
+var AddressOutboundIP AddressSource = func() (string, error) {
+	ip, err := OutboundIP()
+	if err != nil {
+		return "", err
+	}
+	return ip.String(), nil
+}
+
+// AddressOutboundIPVia uses the local IP for outgoing connections to the given address (see OutboundIPVia).
+func AddressOutboundIPVia(addr string) AddressSource {
+	return func() (string, error) {
+		ip, err := OutboundIPVia(addr)
+		if err != nil {
+			return "", err
+		}
+		return ip.String(), nil
+	}
+}
+
+// AddressFQDN uses the fully qualified domain name of the host.
+var AddressFQDN AddressSource = func() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("retrieving Hostname failed %w", err)
+	}
+	addrs, err := net.LookupHost(hostname)
+	if err != nil {
+		return "", fmt.Errorf("resolving hostname failed %w", err)
+	}
+	for _, addr := range addrs {
+		names, err := net.LookupAddr(addr)
+		if err == nil && len(names) > 0 {
+			return strings.TrimSuffix(names[0], "."), nil
+		}
+	}
+	return "", fmt.Errorf("no fqdn found for %s", hostname)
+}
+
+// AddressHostname uses the hostname, which is the default address of the registration.
+var AddressHostname AddressSource = func() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("retrieving Hostname failed %w", err)
+	}
+	return hostname, nil
+}
+
+// WithAddressResolutionOrder registers the service with the first address of the sources which is resolvable.
+// The registration fails if no source yields one. Without this option the hostname is used.
+func WithAddressResolutionOrder(sources ...AddressSource) Option {
+	return withRegistrationStep(func(registration *api.AgentServiceRegistration) error {
+		address, err := resolveAddress(sources)
+		if err != nil {
+			return err
+		}
+		registration.Address = address
+		return nil
+	})
+}
+
+// resolveAddress returns the first usable address of the sources.
+func resolveAddress(sources []AddressSource) (string, error) {
+	var errs []string
+	for _, source := range sources {
+		address, err := source()
+		if err == nil && net.ParseIP(address) == nil {
+			_, err = net.LookupHost(address)
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		return address, nil
+	}
+	if len(errs) == 0 {
+		return "", errors.New("no address source given")
+	}
+	return "", fmt.Errorf("no usable address found %s", strings.Join(errs, ", "))
+}
@@ -0,0 +1,70 @@
+package common
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+)
+
+// proxyAttempts is the number of instances a proxied request without body is tried on.
+const proxyAttempts = 3
+
+// NewServiceReverseProxy returns a reverse proxy sending each request to a healthy instance of the service
+// selected by the balancer, which defaults to round robin if nil.
+// Requests without a body are retried on the next instance if the selected one can't be reached,
+// e.g. because it disappeared since the selection.
+// The scheme of the backend requests is taken like the default scheme of ServiceURL.
+func NewServiceReverseProxy(serviceName string, balancer Balancer) (*httputil.ReverseProxy, error) {
+	if serviceName == "" {
+		return nil, errors.New("the service name must not be empty")
+	}
+	if balancer == nil {
+		balancer = NewRoundRobinBalancer(serviceName)
+	}
+
+	scheme := defaultConfig().scheme()
+	return &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = scheme
+			// an unresolved host is resolved again by the transport which reports the error
+			req.URL.Host = ""
+			if entry, err := balancer.Next(); err == nil {
+				req.URL.Host = entryHostPort(entry)
+			}
+		},
+		Transport: &proxyTransport{balancer: balancer},
+	}, nil
+}
+
+// proxyTransport sends the requests of the reverse proxy and retries unreachable instances.
+type proxyTransport struct {
+	balancer Balancer
+}
+
+func (t *proxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	retryable := req.Body == nil || req.Body == http.NoBody
+
+	var err error
+	for attempt := 0; attempt < proxyAttempts; attempt++ {
+		if req.URL.Host == "" || attempt > 0 {
+			entry, err := t.balancer.Next()
+			if err != nil {
+				if req.Body != nil {
+					_ = req.Body.Close()
+				}
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.URL.Host = entryHostPort(entry)
+		}
+
+		var resp *http.Response
+		resp, err = http.DefaultTransport.RoundTrip(req)
+		var opErr *net.OpError
+		if err == nil || !retryable || !errors.As(err, &opErr) || opErr.Op != "dial" {
+			return resp, err
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,53 @@
+package common
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestServiceReverseProxyUsesWatch(t *testing.T) {
+	var hits [2]int64
+	backends := make([]*httptest.Server, 0, len(hits))
+	for i := range hits {
+		i := i
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&hits[i], 1)
+		}))
+		defer backend.Close()
+		backends = append(backends, backend)
+	}
+	queries, cleanup := startFakeConsul(t, "orders", backends...)
+	defer cleanup()
+
+	proxy, err := NewServiceReverseProxy("orders", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	for i := 0; i < 40; i++ {
+		resp, err := http.Get(server.URL + "/prices")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected the status 200, got %d", resp.StatusCode)
+		}
+	}
+
+	if n := atomic.LoadInt64(queries); n > 2 {
+		t.Errorf("expected at most 2 queries to consul, got %d", n)
+	}
+	// the round robin alternates between the instances
+	for i := range hits {
+		if n := atomic.LoadInt64(&hits[i]); n != 20 {
+			t.Errorf("expected 20 requests to backend %d, got %d", i, n)
+		}
+	}
+}
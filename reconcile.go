@@ -0,0 +1,163 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// ReconcileRegistration registers the desired registration at the local agent unless the registered
+// service already matches it and returns whether the service had to be registered again.
+//
+// It compares the name, address, port, tags, meta data, weights and tag override of the service.
+// The checks are matched by their ID and compared by their type, the name and notes if set, and the settings
+// the agent reports back: the HTTP and TCP targets, method, header, body, TLS settings, interval, timeout and
+// DeregisterCriticalServiceAfter. The agent doesn't report the targets of gRPC and H2PING checks, the TTL of
+// TTL checks and the arguments of script checks, so changes to those alone are not detected.
+func ReconcileRegistration(desired *api.AgentServiceRegistration) (changed bool, err error) {
+	if desired == nil || desired.ID == "" {
+		return false, errors.New("the desired registration needs an ID")
+	}
+
+	consul, err := newClient(defaultConfig())
+	if err != nil {
+		return false, fmt.Errorf("could not create consul client %w", err)
+	}
+
+	services, err := consul.Agent().Services()
+	if err != nil {
+		return false, fmt.Errorf("listing local services failed %w", err)
+	}
+	if actual, ok := services[desired.ID]; ok {
+		checks, err := consul.Agent().ChecksWithFilter(fmt.Sprintf("ServiceID == %q", desired.ID))
+		if err != nil {
+			return false, fmt.Errorf("listing local checks failed %w", err)
+		}
+		if registrationMatches(desired, actual, checks) {
+			return false, nil
+		}
+	}
+
+	err = consul.Agent().ServiceRegisterOpts(desired, api.ServiceRegisterOpts{ReplaceExistingChecks: true})
+	if err != nil {
+		return false, fmt.Errorf("registering to consul failed %w", err)
+	}
+	return true, nil
+}
+
+// registrationMatches reports whether the registered service and its checks match the desired registration.
+func registrationMatches(desired *api.AgentServiceRegistration, actual *api.AgentService, actualChecksByID map[string]*api.AgentCheck) bool {
+	if desired.Name != actual.Service || desired.Address != actual.Address || desired.Port != actual.Port {
+		return false
+	}
+	if !sameStrings(desired.Tags, actual.Tags) || !sameMeta(desired.Meta, actual.Meta) {
+		return false
+	}
+	weights := api.AgentWeights{Passing: 1, Warning: 1}
+	if desired.Weights != nil {
+		weights = *desired.Weights
+	}
+	if weights != actual.Weights || desired.EnableTagOverride != actual.EnableTagOverride {
+		return false
+	}
+
+	desiredChecks := checks(desired)
+	if len(desiredChecks) != len(actualChecksByID) {
+		return false
+	}
+	for i, c := range desiredChecks {
+		actualCheck, ok := actualChecksByID[desiredCheckID(desired.ID, c, i, len(desiredChecks))]
+		if !ok || !checkMatches(c, actualCheck) {
+			return false
+		}
+	}
+	return true
+}
+
+// desiredCheckID returns the ID the agent assigns to the i-th of n checks of the service.
+func desiredCheckID(serviceID string, c *api.AgentServiceCheck, i, n int) string {
+	if c.CheckID != "" {
+		return c.CheckID
+	}
+	if n == 1 {
+		return fmt.Sprintf("service:%s", serviceID)
+	}
+	return fmt.Sprintf("service:%s:%d", serviceID, i+1)
+}
+
+// checkMatches reports whether the registered check matches the desired one as far as the agent reports it.
+func checkMatches(desired *api.AgentServiceCheck, actual *api.AgentCheck) bool {
+	if checkType(desired) != actual.Type {
+		return false
+	}
+	if (desired.Name != "" && desired.Name != actual.Name) || (desired.Notes != "" && desired.Notes != actual.Notes) {
+		return false
+	}
+
+	d := actual.Definition
+	if desired.HTTP != d.HTTP || desired.TCP != d.TCP || desired.Method != d.Method || desired.Body != d.Body {
+		return false
+	}
+	if len(desired.Header) > 0 || len(d.Header) > 0 {
+		if !reflect.DeepEqual(desired.Header, d.Header) {
+			return false
+		}
+	}
+	if desired.TLSServerName != d.TLSServerName || desired.TLSSkipVerify != d.TLSSkipVerify {
+		return false
+	}
+	return sameDuration(desired.Interval, d.IntervalDuration) &&
+		sameDuration(desired.Timeout, d.TimeoutDuration) &&
+		sameDuration(desired.DeregisterCriticalServiceAfter, d.DeregisterCriticalServiceAfterDuration)
+}
+
+// checkType returns the type the agent reports for the check.
+func checkType(c *api.AgentServiceCheck) string {
+	switch {
+	case c.HTTP != "":
+		return "http"
+	case c.TCP != "":
+		return "tcp"
+	case c.GRPC != "":
+		return "grpc"
+	case c.H2PING != "":
+		return "h2ping"
+	case c.TTL != "":
+		return "ttl"
+	case len(c.Args) > 0:
+		return "script"
+	default:
+		return "alias"
+	}
+}
+
+// sameDuration reports whether the desired duration, which may be empty, equals the registered one.
+func sameDuration(desired string, actual time.Duration) bool {
+	if desired == "" {
+		return actual == 0
+	}
+	d, err := time.ParseDuration(desired)
+	return err == nil && d == actual
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	return reflect.DeepEqual(a, b)
+}
+
+func sameMeta(a, b map[string]string) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
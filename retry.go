@@ -0,0 +1,39 @@
+package common
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// retry calls fn until it succeeds or the attempts are used up and returns the last error.
+// The delay between the attempts starts at baseDelay, doubles with each attempt and has up to 50% jitter.
+func retry(ctx context.Context, attempts int, baseDelay time.Duration, fn func() error) error {
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(backoff(baseDelay, i-1)):
+			}
+		}
+
+		if err = fn(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// backoff returns the exponential delay for the given (zero based) retry with up to 50% jitter.
+func backoff(baseDelay time.Duration, retry int) time.Duration {
+	if retry > 16 {
+		retry = 16
+	}
+	delay := baseDelay << uint(retry)
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
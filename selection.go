@@ -0,0 +1,131 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// SelectionStrategy defines how a single instance gets selected from the healthy instances of a service.
+type SelectionStrategy int
+
+const (
+	// SelectRandom selects any instance.
+	SelectRandom SelectionStrategy = iota
+	// SelectNearest selects the instance with the lowest round trip time to the local agent.
+	SelectNearest
+	// SelectHighestWeight selects the instance with the highest passing weight, i.e. the least loaded one.
+	SelectHighestWeight
+)
+
+// selectInstance selects an instance from the services. The services have to be sorted by
+// their round trip time for SelectNearest.
+func selectInstance(services []*api.ServiceEntry, strategy SelectionStrategy) *api.ServiceEntry {
+	if len(services) == 0 {
+		return nil
+	}
+
+	switch strategy {
+	case SelectNearest:
+		return services[0]
+	case SelectHighestWeight:
+		best := services[0]
+		for _, s := range services[1:] {
+			if passingWeight(s) > passingWeight(best) {
+				best = s
+			}
+		}
+		return best
+	default:
+		return services[rand.Intn(len(services))]
+	}
+}
+
+// SingleInstanceCache keeps the best healthy instance of a service up-to-date using a watch,
+// so getting it doesn't cause any traffic to consul.
+type SingleInstanceCache struct {
+	watch *Watch
+
+	mu       sync.RWMutex
+	instance *api.ServiceEntry
+}
+
+// NewSingleInstanceCache starts watching the service and selects its instance using the given strategy.
+// A randomly selected instance is kept as long as it is healthy. The cache stops when the context
+// is cancelled or it gets closed.
+func NewSingleInstanceCache(ctx context.Context, serviceName string, strategy SelectionStrategy) (*SingleInstanceCache, error) {
+	near := ""
+	if strategy == SelectNearest {
+		near = "_agent"
+	}
+	ch, w, err := watchService(ctx, serviceName, near)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &SingleInstanceCache{watch: w}
+	go func() {
+		for services := range ch {
+			c.update(services, strategy)
+		}
+	}()
+	return c, nil
+}
+
+// Get returns the current instance and false if there is no healthy instance.
+func (c *SingleInstanceCache) Get() (*api.ServiceEntry, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.instance, c.instance != nil
+}
+
+// Close stops watching the service.
+func (c *SingleInstanceCache) Close() {
+	c.watch.Stop()
+}
+
+func (c *SingleInstanceCache) update(services []*api.ServiceEntry, strategy SelectionStrategy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if strategy == SelectRandom && c.instance != nil {
+		for _, s := range services {
+			if s.Service.ID == c.instance.Service.ID {
+				c.instance = s
+				return
+			}
+		}
+	}
+	c.instance = selectInstance(services, strategy)
+}
+
+// CallWithFailover calls fn with the healthy instances of the service, nearest to the local agent first,
+// until it succeeds for one of them. It returns the errors of all instances if fn fails for every one.
+// The context is checked before each attempt.
+func CallWithFailover(ctx context.Context, serviceName string, fn func(entry *api.ServiceEntry) error) error {
+	q := (&api.QueryOptions{Near: "_agent"}).WithContext(ctx)
+	services, err := queryServices(serviceName, q)
+	if err != nil {
+		return err
+	}
+	if len(services) == 0 {
+		return fmt.Errorf("no healthy instance of %s found", serviceName)
+	}
+
+	var errs []string
+	for _, s := range services {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := fn(s)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", s.Service.ID, err))
+	}
+	return fmt.Errorf("calling %s failed on all instances %s", serviceName, strings.Join(errs, ", "))
+}
@@ -0,0 +1,104 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// semver is a parsed semantic version, see https://semver.org.
+type semver struct {
+	major, minor, patch uint64
+	// prerelease holds the dot-separated identifiers after the hyphen
+	prerelease []string
+}
+
+// parseSemver parses a semantic version like 1.2.3-rc.1+build, optionally prefixed with v.
+func parseSemver(version string) (semver, error) {
+	v := strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if i := strings.IndexByte(v, '+'); i >= 0 {
+		v = v[:i]
+	}
+
+	var s semver
+	if i := strings.IndexByte(v, '-'); i >= 0 {
+		s.prerelease = strings.Split(v[i+1:], ".")
+		for _, id := range s.prerelease {
+			if id == "" {
+				return semver{}, fmt.Errorf("invalid version %s", version)
+			}
+		}
+		v = v[:i]
+	}
+
+	parts := strings.Split(v, ".")
+	if len(parts) != 3 {
+		return semver{}, fmt.Errorf("invalid version %s", version)
+	}
+	numbers := make([]uint64, 3)
+	for i, p := range parts {
+		n, err := strconv.ParseUint(p, 10, 64)
+		if err != nil || (len(p) > 1 && p[0] == '0') {
+			return semver{}, fmt.Errorf("invalid version %s", version)
+		}
+		numbers[i] = n
+	}
+	s.major, s.minor, s.patch = numbers[0], numbers[1], numbers[2]
+	return s, nil
+}
+
+// compare returns -1, 0 or 1 if the version is lower than, equal to or greater than the other one
+// following the precedence rules of semantic versioning.
+func (s semver) compare(other semver) int {
+	if c := compareUint(s.major, other.major); c != 0 {
+		return c
+	}
+	if c := compareUint(s.minor, other.minor); c != 0 {
+		return c
+	}
+	if c := compareUint(s.patch, other.patch); c != 0 {
+		return c
+	}
+
+	// a pre-release has a lower precedence than the release
+	switch {
+	case len(s.prerelease) == 0 && len(other.prerelease) == 0:
+		return 0
+	case len(s.prerelease) == 0:
+		return 1
+	case len(other.prerelease) == 0:
+		return -1
+	}
+	for i := 0; i < len(s.prerelease) && i < len(other.prerelease); i++ {
+		if c := comparePrerelease(s.prerelease[i], other.prerelease[i]); c != 0 {
+			return c
+		}
+	}
+	return compareUint(uint64(len(s.prerelease)), uint64(len(other.prerelease)))
+}
+
+// comparePrerelease compares numeric identifiers numerically and others lexically,
+// numeric identifiers have a lower precedence than the others.
+func comparePrerelease(a, b string) int {
+	an, aErr := strconv.ParseUint(a, 10, 64)
+	bn, bErr := strconv.ParseUint(b, 10, 64)
+	switch {
+	case aErr == nil && bErr == nil:
+		return compareUint(an, bn)
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func compareUint(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
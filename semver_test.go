@@ -0,0 +1,83 @@
+package common
+
+import "testing"
+
+func TestParseSemver(t *testing.T) {
+	tests := []struct {
+		version string
+		want    semver
+		wantErr bool
+	}{
+		{version: "1.2.3", want: semver{major: 1, minor: 2, patch: 3}},
+		{version: "v1.2.3", want: semver{major: 1, minor: 2, patch: 3}},
+		{version: " 0.10.0 ", want: semver{minor: 10}},
+		{version: "1.0.0-rc.1", want: semver{major: 1, prerelease: []string{"rc", "1"}}},
+		{version: "1.0.0+build.5", want: semver{major: 1}},
+		{version: "1.0.0-beta+exp.sha", want: semver{major: 1, prerelease: []string{"beta"}}},
+		{version: "", wantErr: true},
+		{version: "1.2", wantErr: true},
+		{version: "1.2.3.4", wantErr: true},
+		{version: "01.2.3", wantErr: true},
+		{version: "1.x.3", wantErr: true},
+		{version: "-1.2.3", wantErr: true},
+		{version: "1.2.3-", wantErr: true},
+		{version: "1.2.3-rc..1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			got, err := parseSemver(tt.version)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.compare(tt.want) != 0 || len(got.prerelease) != len(tt.want.prerelease) {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSemverCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{a: "1.0.0", b: "1.0.0", want: 0},
+		{a: "1.0.0+a", b: "1.0.0+b", want: 0},
+		{a: "1.0.0", b: "2.0.0", want: -1},
+		{a: "2.1.0", b: "2.0.9", want: 1},
+		{a: "1.10.0", b: "1.9.0", want: 1},
+		{a: "1.0.10", b: "1.0.9", want: 1},
+		{a: "1.0.0-alpha", b: "1.0.0", want: -1},
+		{a: "1.0.0-alpha", b: "1.0.0-alpha.1", want: -1},
+		{a: "1.0.0-alpha.1", b: "1.0.0-alpha.beta", want: -1},
+		{a: "1.0.0-alpha.beta", b: "1.0.0-beta", want: -1},
+		{a: "1.0.0-beta", b: "1.0.0-beta.2", want: -1},
+		{a: "1.0.0-beta.2", b: "1.0.0-beta.11", want: -1},
+		{a: "1.0.0-beta.11", b: "1.0.0-rc.1", want: -1},
+		{a: "1.0.0-rc.1", b: "1.0.0", want: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a+" "+tt.b, func(t *testing.T) {
+			a, err := parseSemver(tt.a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := parseSemver(tt.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := a.compare(b); got != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, got)
+			}
+			if got := b.compare(a); got != -tt.want {
+				t.Errorf("expected %d for the reverse comparison, got %d", -tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Session is a consul session which gets renewed in the background until it is destroyed
+// or the context passed to Create is cancelled.
+// Its ID can be used to acquire KV entries, e.g. for locks.
+type Session struct {
+	mu     sync.Mutex
+	consul *api.Client
+	id     string
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewSession returns a new session.
+// The session has to be created using Create before it can be used.
+func NewSession() *Session {
+	return &Session{}
+}
+
+// Create creates the session in consul and starts renewing it in the background
+// until the session gets destroyed or the context gets cancelled.
+// The behavior defines what happens to the KV entries held by the session on invalidation
+// and defaults to api.SessionBehaviorRelease.
+func (s *Session) Create(ctx context.Context, ttl time.Duration, behavior string) (id string, err error) {
+	return s.create(ctx, ctx, ttl, behavior)
+}
+
+// create is Create with separate contexts for the creation and the renewal,
+// e.g. to cancel a pending creation without limiting the lifetime of the session.
+func (s *Session) create(ctx, renewCtx context.Context, ttl time.Duration, behavior string) (id string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.id != "" {
+		return "", errors.New("session already created")
+	}
+
+	switch behavior {
+	case "":
+		behavior = api.SessionBehaviorRelease
+	case api.SessionBehaviorRelease, api.SessionBehaviorDelete:
+	default:
+		return "", fmt.Errorf("invalid session behavior %s", behavior)
+	}
+
+	consul, err := newClient(defaultConfig())
+	if err != nil {
+		return "", fmt.Errorf("could not create consul client %w", err)
+	}
+
+	entry := &api.SessionEntry{TTL: ttl.String(), Behavior: behavior}
+	id, _, err = consul.Session().Create(entry, (&api.WriteOptions{}).WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("creating session failed %w", err)
+	}
+
+	renewCtx, cancel := context.WithCancel(renewCtx)
+	s.consul = consul
+	s.id = id
+	s.cancel = cancel
+	s.done = make(chan struct{})
+
+	go func(done chan struct{}) {
+		defer close(done)
+		_ = consul.Session().RenewPeriodic(ttl.String(), id, (&api.WriteOptions{}).WithContext(renewCtx), nil)
+	}(s.done)
+
+	return id, nil
+}
+
+// ID returns the ID of the session or an empty string if it was not created yet.
+func (s *Session) ID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.id
+}
+
+// Done returns a channel which gets closed as soon as the session is not renewed anymore,
+// e.g. because it expired, got destroyed or the context got cancelled.
+func (s *Session) Done() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.done
+}
+
+// Destroy stops the renewal and destroys the session in consul.
+func (s *Session) Destroy(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.id == "" {
+		return nil
+	}
+
+	s.cancel()
+	<-s.done
+
+	_, err := s.consul.Session().Destroy(s.id, (&api.WriteOptions{}).WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("destroying session failed %w", err)
+	}
+
+	s.id = ""
+	return nil
+}
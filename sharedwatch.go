@@ -0,0 +1,119 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// sharedWatch keeps the healthy instances of a service up-to-date using a blocking query,
+// so resolving an instance per request doesn't cause any traffic to consul.
+type sharedWatch struct {
+	watch *Watch
+	// ready gets closed as soon as the first query succeeded or failed
+	ready     chan struct{}
+	readyOnce sync.Once
+
+	mu sync.RWMutex
+	// services are sorted by ID and must not be modified
+	services []*api.ServiceEntry
+	// err is the last error as long as no query succeeded
+	err error
+}
+
+type sharedWatchKey struct {
+	serviceName string
+	client      clientKey
+}
+
+var (
+	sharedWatchesMu sync.Mutex
+	sharedWatches   = make(map[sharedWatchKey]*sharedWatch)
+)
+
+// sharedServices returns the healthy instances of the service sorted by ID. The first call for a service
+// starts a watch which keeps running until StopSharedWatches, later calls don't query consul.
+// The returned slice is shared and must not be modified.
+func sharedServices(serviceName string) ([]*api.ServiceEntry, error) {
+	key := sharedWatchKey{serviceName: serviceName, client: newClientKey(defaultConfig())}
+
+	sharedWatchesMu.Lock()
+	w, ok := sharedWatches[key]
+	if !ok {
+		var err error
+		w, err = startSharedWatch(serviceName)
+		if err != nil {
+			sharedWatchesMu.Unlock()
+			return nil, err
+		}
+		sharedWatches[key] = w
+	}
+	sharedWatchesMu.Unlock()
+
+	<-w.ready
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.services == nil {
+		return nil, w.err
+	}
+	return w.services, nil
+}
+
+func startSharedWatch(serviceName string) (*sharedWatch, error) {
+	ch, watch, err := WatchService(context.Background(), serviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &sharedWatch{watch: watch, ready: make(chan struct{})}
+	go func() {
+		for services := range ch {
+			sorted := make([]*api.ServiceEntry, len(services))
+			copy(sorted, services)
+			sort.Slice(sorted, func(i, j int) bool {
+				return sorted[i].Service.ID < sorted[j].Service.ID
+			})
+
+			w.mu.Lock()
+			w.services, w.err = sorted, nil
+			w.mu.Unlock()
+			w.readyOnce.Do(func() { close(w.ready) })
+		}
+	}()
+	go func() {
+		// failed queries after the first success keep the last known instances
+		for err := range watch.Errors() {
+			w.mu.Lock()
+			if w.services == nil {
+				w.err = err
+			}
+			w.mu.Unlock()
+			w.readyOnce.Do(func() { close(w.ready) })
+		}
+
+		// the watch got stopped before any query succeeded
+		w.mu.Lock()
+		if w.services == nil && w.err == nil {
+			w.err = errors.New("the watch of the service was stopped")
+		}
+		w.mu.Unlock()
+		w.readyOnce.Do(func() { close(w.ready) })
+	}()
+	return w, nil
+}
+
+// StopSharedWatches stops the watches ConsulTransport and the balancers resolve the instances with,
+// e.g. on shutdown. They get started again by the next request.
+func StopSharedWatches() {
+	sharedWatchesMu.Lock()
+	watches := sharedWatches
+	sharedWatches = make(map[sharedWatchKey]*sharedWatch)
+	sharedWatchesMu.Unlock()
+
+	for _, w := range watches {
+		w.watch.Stop()
+	}
+}
@@ -0,0 +1,62 @@
+package common
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// WithAutoDeregisterOnShutdown implements a two-tier cleanup of the registration:
+//
+// On SIGTERM, i.e. an intentional stop like a scale-down, the service gets deregistered immediately.
+// The signal is raised again afterwards, so the process terminates as usual if the application doesn't handle
+// SIGTERM itself. Applications handling it receive the signal a second time after the deregistration.
+//
+// On crashes, the service stays registered, so an instance which restarts quickly keeps its traffic.
+// Consul deregisters it only if its checks stay critical for longer than criticalAfter,
+// which overrides DeregisterCriticalServiceAfter of WithHealthCheckConfig regardless of the order of the options.
+// Settings passed to a single health check option still take precedence for that check.
+// Consul enforces a minimum of one minute.
+func WithAutoDeregisterOnShutdown(criticalAfter time.Duration) Option {
+	return func(o *config) {
+		o.deregisterCriticalAfter = criticalAfter
+		withAfterRegister(func(registration *api.AgentServiceRegistration) error {
+			serviceID := registration.ID
+			startBackground(serviceID, func(ctx context.Context) {
+				deregisterOnSignal(ctx, serviceID, o)
+			})
+			return nil
+		})(o)
+	}
+}
+
+// deregisterOnSignal deregisters the service on SIGTERM until the context is cancelled.
+func deregisterOnSignal(ctx context.Context, serviceID string, cfg *config) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-signals:
+	}
+
+	if err := deregister(serviceID, cfg); err != nil {
+		log.Printf("deregistering on shutdown failed %v", err)
+	}
+
+	signal.Stop(signals)
+	p, err := os.FindProcess(os.Getpid())
+	if err == nil {
+		err = p.Signal(syscall.SIGTERM)
+	}
+	if err != nil {
+		log.Printf("raising SIGTERM again failed %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+)
+
+type serviceNameKey struct{}
+
+// WithServiceName returns a copy of the context carrying the name of the service a request targets.
+// It is used by the ConsulTransport to resolve the backend of the request.
+func WithServiceName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, serviceNameKey{}, name)
+}
+
+// serviceNameFromContext returns the service name set by WithServiceName.
+func serviceNameFromContext(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(serviceNameKey{}).(string)
+	return name, ok && name != ""
+}
+
+// ConsulTransport is a http.RoundTripper which sends each request to any healthy instance of the target service.
+// The service is taken from the request context (see WithServiceName) and falls back to the host of the request URL,
+// e.g. http://pricing/prices is sent to an instance of the service pricing.
+// The instances are kept up-to-date by a watch per service, so the requests don't query consul (see StopSharedWatches).
+type ConsulTransport struct {
+	// Base is used to send the resolved requests. If nil, http.DefaultTransport is used.
+	Base http.RoundTripper
+}
+
+func (t *ConsulTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	serviceName, ok := serviceNameFromContext(req.Context())
+	if !ok {
+		serviceName = req.URL.Hostname()
+	}
+
+	address, err := sharedServiceAddress(serviceName)
+	if err != nil {
+		// a RoundTripper has to close the body even on errors
+		if req.Body != nil {
+			_ = req.Body.Close()
+		}
+		return nil, err
+	}
+
+	// a RoundTripper must not modify the given request
+	req = req.Clone(req.Context())
+	req.URL.Host = address
+
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(req)
+}
+
+// sharedServiceAddress returns the address (host:port) of any healthy instance of the watched service.
+func sharedServiceAddress(serviceName string) (string, error) {
+	services, err := sharedServices(serviceName)
+	if err != nil {
+		return "", err
+	}
+	if len(services) == 0 {
+		return "", fmt.Errorf("no healthy instance of service %s found", serviceName)
+	}
+	return entryHostPort(services[rand.Intn(len(services))]), nil
+}
@@ -0,0 +1,99 @@
+package common
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// startFakeConsul starts a consul answering the health queries of the service with an instance
+// for each backend and blocking the queries waiting for a change. It returns the number of health queries.
+func startFakeConsul(t *testing.T, serviceName string, backends ...*httptest.Server) (queries *int64, cleanup func()) {
+	t.Helper()
+
+	services := make([]*api.ServiceEntry, 0, len(backends))
+	for i, b := range backends {
+		u, err := url.Parse(b.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		host, port, err := net.SplitHostPort(u.Host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		services = append(services, &api.ServiceEntry{
+			Node:    &api.Node{Node: "node", Address: host},
+			Service: &api.AgentService{ID: serviceName + "-" + strconv.Itoa(i), Service: serviceName, Address: host, Port: p},
+		})
+	}
+
+	queries = new(int64)
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/"+serviceName {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		atomic.AddInt64(queries, 1)
+		if r.URL.Query().Get("index") == "1" {
+			// nothing changes, so the blocking query waits until it gets cancelled
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("X-Consul-Index", "1")
+		_ = json.NewEncoder(w).Encode(services)
+	}))
+	restoreEnv := setEnv(t, "CONSUL_HOST", consul.URL)
+
+	return queries, func() {
+		StopSharedWatches()
+		restoreEnv()
+		consul.Close()
+	}
+}
+
+func TestConsulTransportUsesWatch(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	defer backend.Close()
+	queries, cleanup := startFakeConsul(t, "orders", backend)
+	defer cleanup()
+
+	client := &http.Client{Transport: &ConsulTransport{}}
+	for i := 0; i < 50; i++ {
+		resp, err := client.Get("http://orders/prices")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected the status 200, got %d", resp.StatusCode)
+		}
+	}
+
+	// the initial query and the blocking one waiting for changes
+	if n := atomic.LoadInt64(queries); n > 2 {
+		t.Errorf("expected at most 2 queries to consul, got %d", n)
+	}
+}
+
+func TestConsulTransportNoInstance(t *testing.T) {
+	_, cleanup := startFakeConsul(t, "orders")
+	defer cleanup()
+
+	client := &http.Client{Transport: &ConsulTransport{}}
+	if _, err := client.Get("http://orders/prices"); err == nil {
+		t.Fatal("expected an error without healthy instances")
+	}
+}
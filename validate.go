@@ -0,0 +1,134 @@
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Validate checks the connection to consul at startup, so misconfigurations fail fast with a clear error
+// instead of surfacing later during the registration. It verifies that the client can be created,
+// consul is reachable and has a leader, the datacenter exists and the token is valid, if set.
+func Validate(ctx context.Context, options ...Option) error {
+	cfg := defaultConfig()
+	for _, o := range options {
+		o(cfg)
+	}
+
+	consul, err := newClient(cfg)
+	if err != nil {
+		return fmt.Errorf("could not create consul client %w", err)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	datacenters, err := consul.Catalog().Datacenters()
+	if err != nil {
+		return fmt.Errorf("consul is not reachable %w", err)
+	}
+	if cfg.datacenter != "" && !containsString(datacenters, cfg.datacenter) {
+		return fmt.Errorf("the datacenter %s doesn't exist, known datacenters are %s", cfg.datacenter, strings.Join(datacenters, ", "))
+	}
+
+	q := (&api.QueryOptions{}).WithContext(ctx)
+	leader, err := consul.Status().LeaderWithQueryOptions(q)
+	if err != nil {
+		return fmt.Errorf("reading consul leader failed %w", err)
+	}
+	if leader == "" {
+		return errors.New("the consul cluster has no leader")
+	}
+
+	if cfg.token != "" || os.Getenv("CONSUL_HTTP_TOKEN") != "" {
+		_, _, err := consul.ACL().TokenReadSelf(q)
+		// a token can't be invalid if ACLs are disabled
+		if err != nil && !strings.Contains(err.Error(), "ACL support disabled") {
+			return fmt.Errorf("validating consul token failed %w", err)
+		}
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyCheckReachable probes the targets of the HTTP, TCP, gRPC and H2PING checks of the registration
+// from the local process, so a check pointing to an unreachable address fails immediately
+// instead of turning critical in consul later. HTTP checks only need to answer, regardless of the status code.
+// Other kinds of checks are skipped. Note that consul probes from the agent, which may see a different network.
+func VerifyCheckReachable(ctx context.Context, registration *api.AgentServiceRegistration) error {
+	for _, c := range checks(registration) {
+		var err error
+		switch {
+		case c.HTTP != "":
+			err = probeHTTP(ctx, c)
+		case c.TCP != "":
+			err = probeTCP(ctx, c.TCP)
+		case c.GRPC != "":
+			// the target may name the service to check, e.g. host:port/service
+			err = probeTCP(ctx, strings.SplitN(c.GRPC, "/", 2)[0])
+		case c.H2PING != "":
+			err = probeTCP(ctx, c.H2PING)
+		default:
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("the check %s is not reachable %w", checkName(c), err)
+		}
+	}
+	return nil
+}
+
+func probeHTTP(ctx context.Context, check *api.AgentServiceCheck) error {
+	method := check.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	req, err := http.NewRequestWithContext(ctx, method, check.HTTP, nil)
+	if err != nil {
+		return err
+	}
+	for key, values := range check.Header {
+		req.Header[key] = values
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: check.TLSSkipVerify, ServerName: check.TLSServerName}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	defer client.CloseIdleConnections()
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func probeTCP(ctx context.Context, address string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// checkName returns the name of the check or its ID if it has no name.
+func checkName(check *api.AgentServiceCheck) string {
+	if check.Name != "" {
+		return check.Name
+	}
+	return check.CheckID
+}
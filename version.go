@@ -0,0 +1,39 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+)
+
+const modulePath = "github.com/scayle/common-go"
+
+// userAgent returns the default User-Agent of the requests to consul for the given service.
+// Calls which don't know the service, e.g. the discovery, use the name of the executable instead.
+func userAgent(serviceName string) string {
+	if serviceName == "" {
+		serviceName = filepath.Base(os.Args[0])
+	}
+	return fmt.Sprintf("%s common-go/%s", serviceName, libraryVersion())
+}
+
+// libraryVersion returns the version of this library the binary was built with.
+func libraryVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if info.Main.Path == modulePath {
+		return info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == modulePath {
+			if dep.Replace != nil {
+				return dep.Replace.Version
+			}
+			return dep.Version
+		}
+	}
+	return "unknown"
+}
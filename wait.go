@@ -0,0 +1,84 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// RegisterAndWaitHealthy registers the service like RegisterConsulService and blocks until the
+// local consul agent reports all its checks as passing or the context expires.
+func RegisterAndWaitHealthy(ctx context.Context, serviceName string, options ...Option) (*api.AgentServiceRegistration, error) {
+	cfg := defaultConfig()
+	for _, o := range options {
+		o(cfg)
+	}
+
+	registration, err := register(serviceName, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := waitHealthy(ctx, cfg, registration.ID); err != nil {
+		return nil, err
+	}
+	return registration, nil
+}
+
+// waitHealthy blocks until the agent reports the service with the given ID as passing.
+func waitHealthy(ctx context.Context, cfg *config, serviceID string) error {
+	consul, err := newClient(cfg)
+	if err != nil {
+		return fmt.Errorf("could not create consul client %w", err)
+	}
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		status, _, err := consul.Agent().AgentHealthServiceByID(serviceID)
+		if err == nil && status == api.HealthPassing {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if err != nil {
+				return fmt.Errorf("waiting for service %s to be healthy failed %w", serviceID, err)
+			}
+			return fmt.Errorf("waiting for service %s to be healthy failed, last status %s %w", serviceID, status, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// WaitForInstancesMatching blocks until at least count healthy instances of the service match the predicate,
+// e.g. the instances with the tag of a new version during a rolling deploy, or the context expires.
+func WaitForInstancesMatching(ctx context.Context, serviceName string, match func(*api.ServiceEntry) bool, count int) error {
+	ch, w, err := WatchService(ctx, serviceName)
+	if err != nil {
+		return err
+	}
+	defer w.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case services, ok := <-ch:
+			if !ok {
+				return ctx.Err()
+			}
+			matching := 0
+			for _, s := range services {
+				if match(s) {
+					matching++
+				}
+			}
+			if matching >= count {
+				return nil
+			}
+		}
+	}
+}
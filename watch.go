@@ -0,0 +1,215 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Watch is the handle of a running watch on consul.
+type Watch struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	errors chan error
+}
+
+// Stop stops the watch and cancels its running blocking query.
+// It returns as soon as the watch has stopped.
+func (w *Watch) Stop() {
+	w.cancel()
+	<-w.done
+}
+
+// Errors returns a channel receiving the errors of the failed queries of the watch.
+// The watch keeps retrying after errors. Errors get dropped if they are not received fast enough.
+// The channel gets closed when the watch stops.
+func (w *Watch) Errors() <-chan error {
+	return w.errors
+}
+
+// WatchService watches the healthy instances of the service with the given name.
+// The current instances are sent immediately and again whenever they change.
+// The channel gets closed when the watch stops, either by Stop or by cancelling the context.
+func WatchService(ctx context.Context, serviceName string) (<-chan []*api.ServiceEntry, *Watch, error) {
+	return watchService(ctx, serviceName, "")
+}
+
+// watchService watches the service like WatchService and sorts the instances by
+// their round trip time to the given node if near is set.
+func watchService(ctx context.Context, serviceName string, near string) (<-chan []*api.ServiceEntry, *Watch, error) {
+	consul, err := newClient(defaultConfig())
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not create consul client %w", err)
+	}
+
+	ch := make(chan []*api.ServiceEntry)
+	w := startWatch(ctx, func() { close(ch) }, func(ctx context.Context, q *api.QueryOptions) (uint64, error) {
+		q.Near = near
+		services, meta, err := consul.Health().Service(serviceName, "", true, q)
+		if err != nil {
+			return 0, fmt.Errorf("searching for service failed %w", err)
+		}
+		if meta.LastIndex != q.WaitIndex {
+			select {
+			case ch <- services:
+			case <-ctx.Done():
+			}
+		}
+		return meta.LastIndex, nil
+	})
+	return ch, w, nil
+}
+
+// WatchKV watches the KV entry with the given key.
+// The current entry is sent immediately and again whenever it changes. A deleted entry is sent as nil.
+// The channel gets closed when the watch stops, either by Stop or by cancelling the context.
+func WatchKV(ctx context.Context, key string) (<-chan *api.KVPair, *Watch, error) {
+	consul, err := newClient(defaultConfig())
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not create consul client %w", err)
+	}
+
+	ch := make(chan *api.KVPair)
+	w := startWatch(ctx, func() { close(ch) }, func(ctx context.Context, q *api.QueryOptions) (uint64, error) {
+		pair, meta, err := consul.KV().Get(key, q)
+		if err != nil {
+			return 0, fmt.Errorf("reading kv entry failed %w", err)
+		}
+		if meta.LastIndex != q.WaitIndex {
+			select {
+			case ch <- pair:
+			case <-ctx.Done():
+			}
+		}
+		return meta.LastIndex, nil
+	})
+	return ch, w, nil
+}
+
+// startWatch runs the blocking query in the background until the watch gets stopped.
+// The query gets the wait index of the last run and returns the new index.
+// The stopped function gets called after the last query.
+func startWatch(ctx context.Context, stopped func(), query func(ctx context.Context, q *api.QueryOptions) (uint64, error)) *Watch {
+	ctx, cancel := context.WithCancel(ctx)
+	w := &Watch{
+		cancel: cancel,
+		done:   make(chan struct{}),
+		errors: make(chan error, 10),
+	}
+
+	atomic.AddInt64(&activeWatches, 1)
+	go func() {
+		defer close(w.done)
+		defer close(w.errors)
+		defer stopped()
+		defer atomic.AddInt64(&activeWatches, -1)
+
+		var index uint64
+		for {
+			lastIndex, err := query(ctx, (&api.QueryOptions{WaitIndex: index}).WithContext(ctx))
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				select {
+				case w.errors <- err:
+				default:
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Second):
+				}
+				continue
+			}
+
+			// the index may go backwards, e.g. after a restore of consul
+			if lastIndex < index {
+				lastIndex = 0
+			}
+			index = lastIndex
+		}
+	}()
+
+	return w
+}
+
+// OnInstanceRemoved calls fn with the ID of each healthy instance of the service which disappears,
+// i.e. which got unhealthy or deregistered. It allows evicting pooled connections to dead instances.
+// The returned watch has to be stopped when the notifications are not needed anymore.
+func OnInstanceRemoved(serviceName string, fn func(instanceID string)) (*Watch, error) {
+	ch, w, err := WatchService(context.Background(), serviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		var known map[string]bool
+		for services := range ch {
+			current := make(map[string]bool, len(services))
+			for _, s := range services {
+				current[s.Service.ID] = true
+			}
+			for id := range known {
+				if !current[id] {
+					fn(id)
+				}
+			}
+			known = current
+		}
+	}()
+	return w, nil
+}
+
+// ServiceChangeEvent describes the healthy instances of a service which appeared or disappeared.
+type ServiceChangeEvent struct {
+	ServiceName string
+	Added       []Instance
+	Removed     []Instance
+	Timestamp   time.Time
+}
+
+// WatchServiceChanges watches the healthy instances of the service and sends only the changes.
+// The first event contains all current instances as added. The channel gets closed when the context is cancelled.
+func WatchServiceChanges(ctx context.Context, serviceName string) (<-chan ServiceChangeEvent, error) {
+	ch, _, err := WatchService(ctx, serviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan ServiceChangeEvent)
+	go func() {
+		defer close(events)
+
+		known := make(map[string]Instance)
+		for services := range ch {
+			event := ServiceChangeEvent{ServiceName: serviceName, Timestamp: time.Now()}
+			current := make(map[string]Instance, len(services))
+			for _, s := range services {
+				instance := newInstance(s)
+				current[instance.ID] = instance
+				if _, ok := known[instance.ID]; !ok {
+					event.Added = append(event.Added, instance)
+				}
+			}
+			for id, instance := range known {
+				if _, ok := current[id]; !ok {
+					event.Removed = append(event.Removed, instance)
+				}
+			}
+			known = current
+
+			if len(event.Added) == 0 && len(event.Removed) == 0 {
+				continue
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return events, nil
+}